@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	ADAPTIVE_TWOPASS   = "twopass"
+	ADAPTIVE_CRFSEARCH = "crfsearch"
+)
+
+// Defaults for the adaptive settings that aren't set in the config.
+const (
+	defaultAudioBitrate = 192000
+	defaultSamples      = 3
+	defaultSampleLength = 30 * time.Second
+	defaultMinCRF       = 18
+	defaultMaxCRF       = 32
+)
+
+// Encode video to a budget rather than a fixed CRF. The budget is either
+// SizePerHour (e.g. "1.5GiB") of runtime or a total Bitrate (e.g. "2500k"),
+// audio included. twopass encodes at the average bitrate that meets the
+// budget, crfsearch encodes short samples to find the lowest CRF that fits.
+type AdaptiveSettings struct {
+	Mode         string        `yaml:"mode"`
+	SizePerHour  string        `yaml:"size_per_hour"`
+	Bitrate      string        `yaml:"bitrate"`
+	Samples      int           `yaml:"samples"`
+	SampleLength time.Duration `yaml:"sample_length"`
+	MinCRF       int           `yaml:"min_crf"`
+	MaxCRF       int           `yaml:"max_crf"`
+}
+
+// What the adaptive mode settled on for a job.
+type EncodeParams struct {
+	Mode         string `json:"mode"`
+	CRF          int    `json:"crf,omitempty"`
+	VideoBitrate int64  `json:"video_bitrate,omitempty"`
+	passLog      string
+}
+
+func (this EncodeParams) String() string {
+	switch this.Mode {
+	case ADAPTIVE_TWOPASS:
+		return fmt.Sprintf("twopass b:v=%dk", this.VideoBitrate/1000)
+	case ADAPTIVE_CRFSEARCH:
+		return fmt.Sprintf("crfsearch crf=%d", this.CRF)
+	}
+	return ""
+}
+
+func (this *AdaptiveSettings) Prepare() error {
+	switch this.Mode {
+	case "":
+		return nil
+	case ADAPTIVE_TWOPASS, ADAPTIVE_CRFSEARCH:
+	default:
+		return fmt.Errorf("Unknown adaptive mode '%v'", this.Mode)
+	}
+	if this.SizePerHour == "" && this.Bitrate == "" {
+		return fmt.Errorf("Adaptive mode '%v' needs size_per_hour or bitrate", this.Mode)
+	}
+	if this.SizePerHour != "" {
+		if _, err := humanize.ParseBytes(this.SizePerHour); err != nil {
+			return fmt.Errorf("Invalid size_per_hour '%v': %v", this.SizePerHour, err)
+		}
+	}
+	if this.Bitrate != "" {
+		if _, err := parseBitrate(this.Bitrate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Total bits per second the settings allow for.
+func (this *AdaptiveSettings) budget() int64 {
+	if this.Bitrate != "" {
+		b, _ := parseBitrate(this.Bitrate)
+		return b
+	}
+	bytes, _ := humanize.ParseBytes(this.SizePerHour)
+	return int64(bytes) * 8 / 3600
+}
+
+// Parse an ffmpeg style bitrate such as "192k" or "2.5M" into bits/s.
+func parseBitrate(s string) (int64, error) {
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1000
+	case strings.HasSuffix(s, "M"):
+		mult = 1000000
+	}
+	n, err := strconv.ParseFloat(strings.TrimRight(s, "kKM"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid bitrate '%v'", s)
+	}
+	return int64(n * mult), nil
+}
+
+func (this *TranscodeJob) adaptiveSettings() *AdaptiveSettings {
+	if this.Type != MEDIA_VIDEO {
+		return nil
+	}
+	as := &this.Conf.TCSettings.Adaptive
+	if this.Profile != nil && this.Profile.Adaptive != nil {
+		as = this.Profile.Adaptive
+	}
+	if as.Mode == "" {
+		return nil
+	}
+	return as
+}
+
+// Work out the encode parameters for adaptive mode from the probed
+// duration. For crfsearch this runs the sample encodes, so it can take a
+// little while.
+func (this *TranscodeJob) ChooseEncodeParams() error {
+	as := this.adaptiveSettings()
+	if as == nil {
+		return nil
+	}
+	duration := this.ExpectedDuration()
+	if duration <= 0 {
+		return fmt.Errorf("Unable to determine duration of '%v'", this.Job.Path)
+	}
+
+	audio := int64(defaultAudioBitrate)
+	opts := strings.Split(this.Conf.TCSettings.Video, " ")
+	if v := optionValue(opts, "-b:a"); v != "" {
+		if b, err := parseBitrate(v); err == nil {
+			audio = b
+		}
+	}
+	video := as.budget() - audio
+	if video <= 0 {
+		return fmt.Errorf("Budget of %d bits/s doesn't leave room for %d bits/s of audio", as.budget(), audio)
+	}
+
+	params := &EncodeParams{Mode: as.Mode}
+	switch as.Mode {
+	case ADAPTIVE_TWOPASS:
+		params.VideoBitrate = video
+		f, err := ioutil.TempFile("", "tvhtc-passlog-")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		os.Remove(f.Name())
+		params.passLog = f.Name()
+	case ADAPTIVE_CRFSEARCH:
+		crf, err := this.searchCRF(as, opts, duration, video)
+		if err != nil {
+			return err
+		}
+		params.CRF = crf
+	}
+
+	Log.Info("Adaptive encode for '%v' (%.0fs, budget %dk video): %v", this.Job.Title, duration, video/1000, params)
+	this.Encode = params
+	return nil
+}
+
+// Binary search for the lowest CRF whose sample encodes come in under
+// the video bitrate budget. If even the highest CRF is over budget we
+// use it anyway, it's the best we can do.
+func (this *TranscodeJob) searchCRF(as *AdaptiveSettings, opts []string, duration float64, budget int64) (int, error) {
+	samples, length := as.Samples, as.SampleLength
+	if samples <= 0 {
+		samples = defaultSamples
+	}
+	if length <= 0 {
+		length = defaultSampleLength
+	}
+	lo, hi := as.MinCRF, as.MaxCRF
+	if lo <= 0 {
+		lo = defaultMinCRF
+	}
+	if hi <= 0 {
+		hi = defaultMaxCRF
+	}
+
+	dir, err := ioutil.TempDir("", "tvhtc-crfsearch-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	for lo < hi {
+		mid := (lo + hi) / 2
+		rate, err := this.sampleBitrate(opts, mid, samples, length, duration, dir)
+		if err != nil {
+			return 0, err
+		}
+		Log.Debug("CRF %d samples at %dk, budget %dk", mid, rate/1000, budget/1000)
+		if rate <= budget {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
+
+// Encode samples spread evenly through the recording at the given CRF and
+// return the resulting video bitrate.
+func (this *TranscodeJob) sampleBitrate(opts []string, crf, samples int, length time.Duration, duration float64, dir string) (int64, error) {
+	if length.Seconds()*float64(samples) > duration {
+		samples = 1
+		length = time.Duration(duration) * time.Second
+	}
+
+	var totalBytes int64
+	var totalSeconds float64
+	for i := 0; i < samples; i++ {
+		start := duration * float64(i+1) / float64(samples+1)
+		start -= length.Seconds() / 2
+		if start < 0 {
+			start = 0
+		}
+		out := filepath.Join(dir, fmt.Sprintf("sample-%d-%d.mkv", crf, i))
+		args := []string{"-ss", fmt.Sprintf("%.3f", start), "-i", this.Job.Path, "-t", fmt.Sprintf("%.3f", length.Seconds())}
+		args = append(args, this.threadArgs(setOption(opts, "-crf", strconv.Itoa(crf)))...)
+		args = append(args, "-an", "-sn", "-y", out)
+		if cmdout, err := this.RunFFmpeg(args); err != nil {
+			return 0, fmt.Errorf("Sample encode failed: %v: %s", err, lastLine(cmdout))
+		}
+		st, err := os.Stat(out)
+		if err != nil {
+			return 0, err
+		}
+		totalBytes += st.Size()
+		totalSeconds += length.Seconds()
+	}
+	return int64(float64(totalBytes*8) / totalSeconds), nil
+}
+
+// Swap the configured rate control for whatever adaptive mode chose.
+func (this *TranscodeJob) adaptiveArgs(opts []string) []string {
+	if this.Encode == nil {
+		return opts
+	}
+	switch this.Encode.Mode {
+	case ADAPTIVE_CRFSEARCH:
+		opts = setOption(opts, "-crf", strconv.Itoa(this.Encode.CRF))
+	case ADAPTIVE_TWOPASS:
+		opts = removeOption(opts, "-crf")
+		opts = setOption(opts, "-b:v", fmt.Sprintf("%dk", this.Encode.VideoBitrate/1000))
+		opts = append(opts, "-pass", "2", "-passlogfile", this.Encode.passLog)
+	}
+	return opts
+}
+
+// For two-pass encodes, run the analysis pass using the same arguments as
+// the real encode but throwing the output away.
+func (this *TranscodeJob) RunFirstPass(args []string) error {
+	if this.Encode == nil || this.Encode.Mode != ADAPTIVE_TWOPASS {
+		return nil
+	}
+	defer func() {
+		logs, _ := filepath.Glob(this.Encode.passLog + "*")
+		this.scratchFiles = append(this.scratchFiles, logs...)
+	}()
+
+	// Drop the outputs and swap to the first pass
+	end := len(args)
+	for i := 1; i < len(args); i++ {
+		if args[i] == this.TempPath && args[i-1] == "-y" {
+			end = i - 1
+			break
+		}
+	}
+	first := setOption(args[:end], "-pass", "1")
+	first = append(first, "-an", "-f", "null", "-y", os.DevNull)
+	Log.Debug("Executing first pass ffmpeg with arguments: %+v", first)
+	if out, err := this.RunFFmpeg(first); err != nil {
+		return fmt.Errorf("First pass failed: %v: %s", err, lastLine(out))
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What an API token is allowed to do. Admin covers the other two.
+const (
+	SCOPE_SUBMIT = "submit"
+	SCOPE_READ   = "read"
+	SCOPE_ADMIN  = "admin"
+)
+
+const authRealm = "TVHTC"
+
+// Who can talk to the API and how. Listen is host:port, or just a host to
+// use the port from -p. With no tokens configured the API is open to
+// anyone who can reach it, as it always was.
+type APISettings struct {
+	Listen    string            `yaml:"listen"`
+	Tokens    []*APIToken       `yaml:"tokens"`
+	Dashboard DashboardSettings `yaml:"dashboard"`
+	TLS       TLSSettings       `yaml:"tls"`
+}
+
+type APIToken struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// Basic auth for the dashboard. Whoever logs in gets admin, so they can
+// use the buttons, but only for reads and the dashboard's own requests as
+// the browser will send the login along with requests from other sites.
+type DashboardSettings struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type TLSSettings struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (this *APISettings) Prepare() error {
+	for i, t := range this.Tokens {
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("token%d", i+1)
+		}
+		if t.Token == "" {
+			return fmt.Errorf("API token %v has no token set", t.Name)
+		}
+		if len(t.Scopes) == 0 {
+			return fmt.Errorf("API token %v has no scopes", t.Name)
+		}
+		for _, s := range t.Scopes {
+			switch s {
+			case SCOPE_SUBMIT, SCOPE_READ, SCOPE_ADMIN:
+			default:
+				return fmt.Errorf("API token %v has unknown scope '%v', expected submit, read or admin", t.Name, s)
+			}
+		}
+	}
+	if (this.Dashboard.Username == "") != (this.Dashboard.Password == "") {
+		return fmt.Errorf("Dashboard auth needs both a username and a password")
+	}
+	if (this.TLS.Cert == "") != (this.TLS.Key == "") {
+		return fmt.Errorf("TLS needs both a cert and a key")
+	}
+	return nil
+}
+
+// The address to listen on, falling back to port on all interfaces.
+func (this *APISettings) Address(port int) string {
+	if this.Listen == "" {
+		return fmt.Sprintf(":%d", port)
+	}
+	if _, _, err := net.SplitHostPort(this.Listen); err == nil {
+		return this.Listen
+	}
+	return net.JoinHostPort(strings.Trim(this.Listen, "[]"), fmt.Sprint(port))
+}
+
+func (this *APISettings) Open() bool {
+	return len(this.Tokens) == 0 && this.Dashboard.Username == ""
+}
+
+func (this *APIToken) Allows(scope string) bool {
+	for _, s := range this.Scopes {
+		if s == scope || s == SCOPE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Pull a token out of "Authorization: Bearer x" or X-API-Token.
+func requestToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return c.GetHeader("X-API-Token")
+}
+
+// Whether a request made with the dashboard login came from the dashboard
+// itself. Browsers say where a request came from in Sec-Fetch-Site, or
+// Origin on older ones, and a form on another site can't send JSON.
+func dashboardRequest(r *http.Request) error {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return nil
+	}
+	if ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || ct != "application/json" {
+		return fmt.Errorf("Dashboard requests must be JSON")
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		if site != "same-origin" {
+			return fmt.Errorf("Cross-site request refused")
+		}
+		return nil
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host == "" || origin.Host != r.Host {
+		return fmt.Errorf("Cross-site request refused")
+	}
+	return nil
+}
+
+// Work out what the request is allowed to do. ok is false if it tried to
+// authenticate and got it wrong.
+func (this *Config) authorise(c *gin.Context, scope string) (allowed, ok bool) {
+	this.RLock()
+	defer this.RUnlock()
+	api := &this.API
+	if api.Open() {
+		return true, true
+	}
+
+	if user, pass, isBasic := c.Request.BasicAuth(); isBasic {
+		if api.Dashboard.Username == "" || !secretEqual(user, api.Dashboard.Username) || !secretEqual(pass, api.Dashboard.Password) {
+			return false, false
+		}
+		c.Set("auth", "dashboard:"+user)
+		if err := dashboardRequest(c.Request); err != nil {
+			c.Set("denied", err.Error())
+			return false, true
+		}
+		return true, true
+	}
+
+	token := requestToken(c)
+	if token == "" {
+		return false, true
+	}
+	for _, t := range api.Tokens {
+		if secretEqual(token, t.Token) {
+			c.Set("auth", "token:"+t.Name)
+			return t.Allows(scope), true
+		}
+	}
+	return false, false
+}
+
+func (this *Config) challenge(c *gin.Context) {
+	this.RLock()
+	defer this.RUnlock()
+	if this.API.Dashboard.Username != "" {
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm="%v"`, authRealm))
+	} else {
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%v"`, authRealm))
+	}
+}
+
+// Middleware rejecting requests that can't do scope.
+func (this *Config) Require(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, ok := this.authorise(c, scope)
+		switch {
+		case !ok:
+			Log.Warning("Bad credentials from %v for %v %v", c.ClientIP(), c.Request.Method, c.Request.URL.Path)
+			this.challenge(c)
+			c.AbortWithStatusJSON(401, gin.H{"status": "error", "message": "Invalid credentials"})
+		case allowed:
+			c.Next()
+		case c.GetString("auth") == "":
+			this.challenge(c)
+			c.AbortWithStatusJSON(401, gin.H{"status": "error", "message": "Authentication required"})
+		default:
+			Log.Warning("%v from %v is not allowed to %v %v", c.GetString("auth"), c.ClientIP(), c.Request.Method, c.Request.URL.Path)
+			msg := fmt.Sprintf("Token lacks the %v scope", scope)
+			if denied := c.GetString("denied"); denied != "" {
+				msg = denied
+			}
+			c.AbortWithStatusJSON(403, gin.H{"status": "error", "message": msg})
+		}
+	}
+}
+
+// Middleware for the dashboard pages. Only basic auth guards these, the
+// page itself has no data in it and asks for a token if the API wants one.
+func (this *Config) RequireDashboard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		this.RLock()
+		user, pass := this.API.Dashboard.Username, this.API.Dashboard.Password
+		this.RUnlock()
+		if user == "" {
+			c.Next()
+			return
+		}
+		u, p, ok := c.Request.BasicAuth()
+		if !ok || !secretEqual(u, user) || !secretEqual(p, pass) {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm="%v"`, authRealm))
+			c.AbortWithStatus(401)
+			return
+		}
+		c.Next()
+	}
+}
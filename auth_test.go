@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPISettingsPrepare(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings APISettings
+		wantErr  bool
+	}{
+		{"empty", APISettings{}, false},
+		{"good token", APISettings{Tokens: []*APIToken{{Token: "x", Scopes: []string{SCOPE_READ}}}}, false},
+		{"no token", APISettings{Tokens: []*APIToken{{Name: "a", Scopes: []string{SCOPE_READ}}}}, true},
+		{"no scopes", APISettings{Tokens: []*APIToken{{Token: "x"}}}, true},
+		{"bad scope", APISettings{Tokens: []*APIToken{{Token: "x", Scopes: []string{"write"}}}}, true},
+		{"dashboard without password", APISettings{Dashboard: DashboardSettings{Username: "admin"}}, true},
+		{"cert without key", APISettings{TLS: TLSSettings{Cert: "/c.pem"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.settings.Prepare(); (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAPISettingsAddress(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   string
+	}{
+		{"", ":8998"},
+		{"127.0.0.1", "127.0.0.1:8998"},
+		{"127.0.0.1:9000", "127.0.0.1:9000"},
+		{"::1", "[::1]:8998"},
+		{"[::1]", "[::1]:8998"},
+		{"[::1]:9000", "[::1]:9000"},
+	}
+	for _, tt := range tests {
+		api := &APISettings{Listen: tt.listen}
+		if got := api.Address(8998); got != tt.want {
+			t.Errorf("Address(%q) = %q, want %q", tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{[]string{SCOPE_SUBMIT}, SCOPE_SUBMIT, true},
+		{[]string{SCOPE_SUBMIT}, SCOPE_READ, false},
+		{[]string{SCOPE_READ}, SCOPE_ADMIN, false},
+		{[]string{SCOPE_ADMIN}, SCOPE_SUBMIT, true},
+		{[]string{SCOPE_ADMIN}, SCOPE_READ, true},
+		{[]string{SCOPE_SUBMIT, SCOPE_READ}, SCOPE_READ, true},
+	}
+	for _, tt := range tests {
+		token := &APIToken{Scopes: tt.scopes}
+		if got := token.Allows(tt.scope); got != tt.want {
+			t.Errorf("%v allows %v = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	secured := NewConfig()
+	secured.API = APISettings{
+		Tokens: []*APIToken{
+			{Name: "tvheadend", Token: "submit-token", Scopes: []string{SCOPE_SUBMIT}},
+			{Name: "admin", Token: "admin-token", Scopes: []string{SCOPE_ADMIN}},
+		},
+		Dashboard: DashboardSettings{Username: "admin", Password: "secret"},
+	}
+	open := NewConfig()
+
+	tests := []struct {
+		name    string
+		conf    *Config
+		scope   string
+		method  string
+		headers map[string]string
+		basic   []string
+		want    int
+	}{
+		{"open API", &open, SCOPE_ADMIN, "GET", nil, nil, 200},
+		{"no credentials", &secured, SCOPE_READ, "GET", nil, nil, 401},
+		{"bearer token", &secured, SCOPE_SUBMIT, "GET", map[string]string{"Authorization": "Bearer submit-token"}, nil, 200},
+		{"lower case bearer", &secured, SCOPE_SUBMIT, "GET", map[string]string{"Authorization": "bearer submit-token"}, nil, 200},
+		{"header token", &secured, SCOPE_SUBMIT, "GET", map[string]string{"X-API-Token": "submit-token"}, nil, 200},
+		{"missing scope", &secured, SCOPE_READ, "GET", map[string]string{"Authorization": "Bearer submit-token"}, nil, 403},
+		{"admin covers read", &secured, SCOPE_READ, "GET", map[string]string{"Authorization": "Bearer admin-token"}, nil, 200},
+		{"wrong token", &secured, SCOPE_READ, "GET", map[string]string{"Authorization": "Bearer nope"}, nil, 401},
+		{"dashboard login", &secured, SCOPE_ADMIN, "GET", nil, []string{"admin", "secret"}, 200},
+		{"wrong password", &secured, SCOPE_READ, "GET", nil, []string{"admin", "nope"}, 401},
+		{"dashboard XHR", &secured, SCOPE_ADMIN, "POST", map[string]string{"Content-Type": "application/json", "Sec-Fetch-Site": "same-origin"}, []string{"admin", "secret"}, 200},
+		{"dashboard XHR, Origin only", &secured, SCOPE_ADMIN, "PATCH", map[string]string{"Content-Type": "application/json", "Origin": "http://example.com"}, []string{"admin", "secret"}, 200},
+		{"cross-origin form with dashboard login", &secured, SCOPE_SUBMIT, "POST", map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Origin": "http://evil.example", "Sec-Fetch-Site": "cross-site"}, []string{"admin", "secret"}, 403},
+		{"cross-site JSON with dashboard login", &secured, SCOPE_ADMIN, "POST", map[string]string{"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site"}, []string{"admin", "secret"}, 403},
+		{"dashboard login without an origin", &secured, SCOPE_ADMIN, "POST", map[string]string{"Content-Type": "application/json"}, []string{"admin", "secret"}, 403},
+		{"token needs no origin", &secured, SCOPE_SUBMIT, "POST", map[string]string{"Authorization": "Bearer submit-token"}, nil, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Any("/", tt.conf.Require(tt.scope), func(c *gin.Context) {
+				c.String(200, "ok")
+			})
+			req := httptest.NewRequest(tt.method, "/", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if tt.basic != nil {
+				req.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got HTTP %v, want %v", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
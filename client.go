@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const submitUsage = `Usage: tvhtc submit [options] {path} {channel} {title} {status} {description}
+Your postprocessor command in tvheadend should be:
+    /usr/local/bin/tvhtc submit "%f" "%c" "%t" "%e" "%d"
+
+Options:
+`
+
+// Longest we'll wait between attempts to reach the daemon.
+const maxSubmitBackoff = 30 * time.Second
+
+type submitResponse struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	ID        int64  `json:"id"`
+	State     string `json:"state"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+// The daemon said no and asking again won't change its mind.
+type rejectedError struct {
+	code    int
+	message string
+}
+
+func (this *rejectedError) Error() string {
+	return fmt.Sprintf("HTTP %v: %v", this.code, this.message)
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func submitClient(caFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if caFile == "" {
+		return client, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %v", caFile)
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client, nil
+}
+
+func postJob(client *http.Client, url, token string, job *TVHJob) (*submitResponse, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return nil, &rejectedError{0, err.Error()}
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, &rejectedError{0, err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", job.IdempotencyKey)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, _ := ioutil.ReadAll(resp.Body)
+	sr := &submitResponse{}
+	if err := json.Unmarshal(raw, sr); err != nil {
+		sr.Message = strings.TrimSpace(string(raw))
+	}
+	switch {
+	case resp.StatusCode == 200 && sr.Status == "ok":
+		return sr, nil
+	// Daemon trouble or rate limiting, try again
+	case resp.StatusCode >= 500 || resp.StatusCode == 429:
+		return nil, fmt.Errorf("HTTP %v: %v", resp.StatusCode, sr.Message)
+	}
+	return nil, &rejectedError{resp.StatusCode, sr.Message}
+}
+
+// Keep trying to hand the job over, backing off between attempts, until
+// it's accepted, rejected or wait runs out.
+func submitWithRetry(client *http.Client, url, token string, job *TVHJob, wait time.Duration) (*submitResponse, error) {
+	deadline := time.Now().Add(wait)
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		sr, err := postJob(client, url, token, job)
+		if err == nil {
+			return sr, nil
+		}
+		if _, ok := err.(*rejectedError); ok {
+			return nil, err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("Gave up after %v attempts: %v", attempt, err)
+		}
+		Log.Warning("Attempt %v to queue job failed, retrying in %v: %v", attempt, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxSubmitBackoff {
+			backoff = maxSubmitBackoff
+		}
+	}
+}
+
+// `tvhtc submit`, the TVHeadend post-processor hook. Returns the exit
+// code.
+func RunSubmit(args []string) int {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	url := fs.String("url", "http://127.0.0.1:8998", "Address of the tvhtc daemon")
+	token := fs.String("token", os.Getenv("TVHTC_TOKEN"), "API token with the submit scope, defaults to $TVHTC_TOKEN")
+	tokenFile := fs.String("token-file", "", "Read the API token from this file")
+	caFile := fs.String("ca", "", "CA certificate to trust if the daemon uses TLS with a private CA")
+	spool := fs.String("spool", defaultSpoolDir, "Where to leave the job if the daemon can't be reached")
+	wait := fs.Duration("wait", 2*time.Minute, "How long to keep retrying before spooling the job")
+	debug := fs.Bool("d", false, "Only log to stderr")
+	fs.Usage = func() {
+		os.Stderr.WriteString(submitUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	backends := []logging.Backend{logging.NewLogBackend(os.Stderr, "", 0)}
+	if !*debug {
+		if sb, err := logging.NewSyslogBackend("tvhtc-submit"); err == nil {
+			backends = append(backends, sb)
+		}
+	}
+	logging.SetBackend(backends...)
+	logging.SetFormatter(syslogFormat)
+
+	if fs.NArg() != 5 {
+		fs.Usage()
+		return 2
+	}
+	if *tokenFile != "" {
+		raw, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			Log.Error("Unable to read token file: %v", err)
+			return 1
+		}
+		*token = strings.TrimSpace(string(raw))
+	}
+
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		path = fs.Arg(0)
+	}
+	job := &TVHJob{
+		Path:           path,
+		Filename:       filepath.Base(path),
+		Channel:        fs.Arg(1),
+		Title:          fs.Arg(2),
+		Status:         fs.Arg(3),
+		Description:    fs.Arg(4),
+		IdempotencyKey: newIdempotencyKey(),
+	}
+
+	client, err := submitClient(*caFile)
+	if err != nil {
+		Log.Error(err.Error())
+		return 1
+	}
+	sr, err := submitWithRetry(client, strings.TrimSuffix(*url, "/")+"/job", *token, job, *wait)
+	if err == nil {
+		if sr.Duplicate {
+			Log.Info("'%v' is already job %v (%v)", job.Title, sr.ID, sr.State)
+		} else {
+			Log.Info("Queued '%v' as job %v", job.Title, sr.ID)
+		}
+		return 0
+	}
+	if _, ok := err.(*rejectedError); ok {
+		Log.Error("Job for '%v' rejected: %v", path, err)
+		return 1
+	}
+
+	Log.Warning("Unable to reach tvhtc: %v", err)
+	spooled, err := SpoolJob(*spool, job)
+	if err != nil {
+		Log.Error("Job for '%v' lost: %v", path, err)
+		return 1
+	}
+	Log.Warning("Spooled job for '%v' to %v, the daemon will pick it up", path, spooled)
+	return 0
+}
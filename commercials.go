@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	COMSKIP_DETECTOR     = "comskip"
+	BLACKDETECT_DETECTOR = "blackdetect"
+
+	COMMERCIAL_EDL      = "edl"
+	COMMERCIAL_CHAPTERS = "chapters"
+	COMMERCIAL_CUT      = "cut"
+)
+
+// Defaults for the blackdetect heuristics. UK ad breaks are a run of
+// adverts (each under a minute or so) bounded by black, silent frames.
+const (
+	defaultMaxAdLength = 65 * time.Second
+	defaultMinBreak    = 60 * time.Second
+	defaultMaxBreak    = 8 * time.Minute
+)
+
+// Commercial detection settings for a set of channels. The first entry
+// whose channel patterns match the recording is used.
+type CommercialSettings struct {
+	Channels    []string      `yaml:"channels"`
+	Detector    string        `yaml:"detector"`
+	Action      string        `yaml:"action"`
+	Comskip     string        `yaml:"comskip"`
+	ComskipINI  string        `yaml:"comskip_ini"`
+	MaxAdLength time.Duration `yaml:"max_ad_length"`
+	MinBreak    time.Duration `yaml:"min_break"`
+	MaxBreak    time.Duration `yaml:"max_break"`
+	channels    []*regexp.Regexp
+}
+
+// A detected advert break, in seconds from the start of the recording.
+type Segment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+func (this Segment) Duration() float64 {
+	return this.End - this.Start
+}
+
+func (this *CommercialSettings) Prepare() error {
+	var err error
+	if this.channels, err = compilePatterns(this.Channels); err != nil {
+		return err
+	}
+	switch this.Detector {
+	case "":
+		this.Detector = BLACKDETECT_DETECTOR
+	case BLACKDETECT_DETECTOR, COMSKIP_DETECTOR:
+	default:
+		return fmt.Errorf("Unknown commercial detector '%v'", this.Detector)
+	}
+	switch this.Action {
+	case "":
+		this.Action = COMMERCIAL_EDL
+	case COMMERCIAL_EDL, COMMERCIAL_CHAPTERS, COMMERCIAL_CUT:
+	default:
+		return fmt.Errorf("Unknown commercial action '%v'", this.Action)
+	}
+	if this.Detector == COMSKIP_DETECTOR && this.Comskip == "" {
+		this.Comskip = "comskip"
+	}
+	return nil
+}
+
+func (this *Config) CommercialSettingsFor(channel string) *CommercialSettings {
+	this.RLock()
+	defer this.RUnlock()
+
+	for _, cs := range this.Commercials {
+		if matchAny(cs.channels, channel) {
+			return cs
+		}
+	}
+	return nil
+}
+
+// Look for advert breaks in the source recording, if commercial detection
+// is configured for its channel. The segments found are kept on the job
+// and recorded in the database.
+func (this *TranscodeJob) DetectCommercials() error {
+	if this.Type != MEDIA_VIDEO {
+		return nil
+	}
+	cs := this.Conf.CommercialSettingsFor(this.Job.Channel)
+	if cs == nil {
+		return nil
+	}
+	this.CommercialAction = cs.Action
+
+	Log.Info("Running %v commercial detection on '%v'", cs.Detector, this.Job.Title)
+	var segments []Segment
+	var err error
+	switch cs.Detector {
+	case COMSKIP_DETECTOR:
+		segments, err = this.detectComskip(cs)
+	default:
+		segments, err = this.detectBlack(cs)
+	}
+	if err != nil {
+		return err
+	}
+
+	Log.Info("Found %d commercial break(s) in '%v'", len(segments), this.Job.Title)
+	this.Commercials = segments
+	if err := this.DB.SetCommercials(this.Job.DBID, cs.Detector, segments); err != nil {
+		Log.Error(err.Error())
+	}
+	return nil
+}
+
+func (this *TranscodeJob) detectComskip(cs *CommercialSettings) ([]Segment, error) {
+	dir, err := ioutil.TempDir("", "tvhtc-comskip-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"--output=" + dir, "--quiet"}
+	if cs.ComskipINI != "" {
+		args = append(args, "--ini="+cs.ComskipINI)
+	}
+	args = append(args, this.Job.Path)
+	Log.Debug("Executing command %v with arguments: %+v", cs.Comskip, args)
+	// comskip exits 1 when it finds no commercials, so only treat a
+	// missing EDL as failure.
+	out, cerr := this.RunLimited(cs.Comskip, args)
+
+	base := strings.TrimSuffix(filepath.Base(this.Job.Path), filepath.Ext(this.Job.Path))
+	edl, err := ioutil.ReadFile(filepath.Join(dir, base+".edl"))
+	if os.IsNotExist(err) {
+		if cerr != nil {
+			return nil, fmt.Errorf("comskip failed: %v: %s", cerr, out)
+		}
+		return []Segment{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseEDL(edl)
+}
+
+// Parse an EDL as written by comskip (and read by Kodi): one segment per
+// line, "start end type" in seconds.
+func ParseEDL(edl []byte) ([]Segment, error) {
+	segments := make([]Segment, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(edl))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		start, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad EDL line '%v': %v", scanner.Text(), err)
+		}
+		end, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad EDL line '%v': %v", scanner.Text(), err)
+		}
+		segments = append(segments, Segment{Start: start, End: end})
+	}
+	return segments, scanner.Err()
+}
+
+var blackLine = regexp.MustCompile(`black_start:\s*([\d.]+)\s+black_end:\s*([\d.]+)`)
+var silenceStartLine = regexp.MustCompile(`silence_start:\s*(-?[\d.]+)`)
+var silenceEndLine = regexp.MustCompile(`silence_end:\s*([\d.]+)`)
+
+// Find breaks using ffmpeg's blackdetect and silencedetect filters. Points
+// where the picture is black and the audio silent at the same time are
+// treated as boundaries between programme and adverts, and runs of
+// closely spaced boundaries of a plausible length become breaks.
+func (this *TranscodeJob) detectBlack(cs *CommercialSettings) ([]Segment, error) {
+	args := []string{"-hide_banner", "-nostats", "-i", this.Job.Path,
+		"-vf", "blackdetect=d=0.1:pix_th=0.10", "-af", "silencedetect=n=-50dB:d=0.1",
+		"-f", "null", "-"}
+	Log.Debug("Executing command ffmpeg with arguments: %+v", args)
+	out, err := this.RunFFmpeg(args)
+	if err != nil {
+		return nil, fmt.Errorf("Black/silence detection failed: %v", err)
+	}
+
+	black := make([]Segment, 0)
+	silence := make([]Segment, 0)
+	var silenceStart float64
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := blackLine.FindStringSubmatch(line); m != nil {
+			s, _ := strconv.ParseFloat(m[1], 64)
+			e, _ := strconv.ParseFloat(m[2], 64)
+			black = append(black, Segment{Start: s, End: e})
+		} else if m := silenceStartLine.FindStringSubmatch(line); m != nil {
+			silenceStart, _ = strconv.ParseFloat(m[1], 64)
+		} else if m := silenceEndLine.FindStringSubmatch(line); m != nil {
+			e, _ := strconv.ParseFloat(m[1], 64)
+			silence = append(silence, Segment{Start: silenceStart, End: e})
+		}
+	}
+
+	boundaries := make([]float64, 0)
+	for _, b := range black {
+		for _, s := range silence {
+			if b.Start < s.End && s.Start < b.End {
+				boundaries = append(boundaries, (b.Start+b.End)/2)
+				break
+			}
+		}
+	}
+	sort.Float64s(boundaries)
+
+	return groupBreaks(boundaries, cs), nil
+}
+
+func groupBreaks(boundaries []float64, cs *CommercialSettings) []Segment {
+	maxAd, minBreak, maxBreak := cs.MaxAdLength, cs.MinBreak, cs.MaxBreak
+	if maxAd <= 0 {
+		maxAd = defaultMaxAdLength
+	}
+	if minBreak <= 0 {
+		minBreak = defaultMinBreak
+	}
+	if maxBreak <= 0 {
+		maxBreak = defaultMaxBreak
+	}
+
+	segments := make([]Segment, 0)
+	for i := 0; i < len(boundaries); {
+		j := i
+		for j+1 < len(boundaries) && boundaries[j+1]-boundaries[j] <= maxAd.Seconds() {
+			j++
+		}
+		seg := Segment{Start: boundaries[i], End: boundaries[j]}
+		if seg.Duration() >= minBreak.Seconds() && seg.Duration() <= maxBreak.Seconds() {
+			segments = append(segments, seg)
+		}
+		i = j + 1
+	}
+	return segments
+}
+
+// Total length of the detected breaks in seconds.
+func (this *TranscodeJob) CommercialDuration() float64 {
+	total := 0.0
+	for _, s := range this.Commercials {
+		total += s.Duration()
+	}
+	return total
+}
+
+// Add whatever the configured action needs to the ffmpeg command line.
+// Cutting is done with select/aselect filters, chapters come from an
+// ffmetadata file passed as an extra input.
+func (this *TranscodeJob) commercialArgs(inputs, opts []string) ([]string, []string, error) {
+	if len(this.Commercials) == 0 {
+		return inputs, opts, nil
+	}
+
+	if this.CommercialAction == COMMERCIAL_CHAPTERS {
+		meta, err := this.writeChapters()
+		if err != nil {
+			return nil, nil, err
+		}
+		this.chapterInput = countInputs(inputs)
+		inputs = append(inputs, "-f", "ffmetadata", "-i", meta)
+	}
+	return inputs, this.commercialOutputOpts(opts), nil
+}
+
+// The per-output half of commercialArgs, for when the inputs are already
+// set up.
+func (this *TranscodeJob) commercialOutputOpts(opts []string) []string {
+	if len(this.Commercials) == 0 {
+		return opts
+	}
+
+	switch this.CommercialAction {
+	case COMMERCIAL_CUT:
+		keep := make([]string, len(this.Commercials))
+		for i, s := range this.Commercials {
+			keep[i] = fmt.Sprintf("between(t,%.3f,%.3f)", s.Start, s.End)
+		}
+		expr := strings.Join(keep, "+")
+		if this.Type == MEDIA_VIDEO {
+			opts = addFilter(opts, "-vf", fmt.Sprintf("select='not(%v)',setpts=N/FRAME_RATE/TB", expr))
+		}
+		opts = addFilter(opts, "-af", fmt.Sprintf("aselect='not(%v)',asetpts=N/SR/TB", expr))
+	case COMMERCIAL_CHAPTERS:
+		if this.chapterInput > 0 {
+			opts = append(opts, "-map_chapters", strconv.Itoa(this.chapterInput))
+		}
+	}
+	return opts
+}
+
+// Number of -i options, which is also the index the next input will get.
+func countInputs(inputs []string) int {
+	n := 0
+	for _, a := range inputs {
+		if a == "-i" {
+			n++
+		}
+	}
+	return n
+}
+
+// Put filter at the front of an existing filter chain for flag, or add
+// the flag if there isn't one.
+func addFilter(opts []string, flag, filter string) []string {
+	for i := 0; i < len(opts)-1; i++ {
+		if opts[i] == flag {
+			opts[i+1] = filter + "," + opts[i+1]
+			return opts
+		}
+	}
+	return append(opts, flag, filter)
+}
+
+// Write an ffmetadata file with alternating programme and advert chapters.
+func (this *TranscodeJob) writeChapters() (string, error) {
+	f, err := ioutil.TempFile("", "tvhtc-chapters-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	this.scratchFiles = append(this.scratchFiles, f.Name())
+	this.chapterFile = f.Name()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, ";FFMETADATA1")
+	chapter := func(start, end float64, title string) {
+		if end-start <= 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%v\n", int64(start*1000), int64(end*1000), title)
+	}
+	pos := 0.0
+	for _, s := range this.Commercials {
+		chapter(pos, s.Start, "Programme")
+		chapter(s.Start, s.End, "Advert")
+		pos = s.End
+	}
+	if src, err := this.ProbeSource(); err == nil {
+		chapter(pos, src.Duration(), "Programme")
+	}
+	return f.Name(), w.Flush()
+}
+
+// Write a Kodi-style .edl sidecar next to the output so players skip the
+// breaks. Only for the edl action, the others have dealt with them already.
+func (this *TranscodeJob) WriteEDL(ctx context.Context) error {
+	if this.CommercialAction != COMMERCIAL_EDL || len(this.Commercials) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, s := range this.Commercials {
+		// Type 3 is a commercial break
+		fmt.Fprintf(&buf, "%.2f\t%.2f\t3\n", s.Start, s.End)
+	}
+	path := this.sidecarBase() + ".edl"
+	Log.Debug("Writing EDL to %v", path)
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
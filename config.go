@@ -6,22 +6,74 @@ import (
 	"io/ioutil"
 	"regexp"
 	"sync"
+	"time"
 )
 
 type Config struct {
 	sync.RWMutex
-	FromAddress   string             `yaml:"from_addr"`
-	EmailHost     string             `yaml:"email_host"`
-	PushoverToken string             `yaml:"pushover_app_token"`
-	KeepOriginals bool               `yaml:"keep_originals"`
-	TCSettings    TranscodeSettings  `yaml:"transcode_settings"`
-	NotifyList    map[string]*Person `yaml:"notify_list"`
-	TrimPath      string             `yaml:"trim_path"`
+	FromAddress   string                `yaml:"from_addr"`
+	EmailHost     string                `yaml:"email_host"`
+	PushoverToken string                `yaml:"pushover_app_token"`
+	KeepOriginals bool                  `yaml:"keep_originals"`
+	TCSettings    TranscodeSettings     `yaml:"transcode_settings"`
+	NotifyList    map[string]*Person    `yaml:"notify_list"`
+	TrimPath      string                `yaml:"trim_path"`
+	ScratchDir    string                `yaml:"scratch_dir"`
+	SpoolDir      string                `yaml:"spool_dir"`
+	Verify        VerifySettings        `yaml:"verify"`
+	Trash         TrashSettings         `yaml:"trash"`
+	Output        OutputSettings        `yaml:"output"`
+	NFO           NFOSettings           `yaml:"nfo"`
+	Profiles      []*Profile            `yaml:"profiles"`
+	Commercials   []*CommercialSettings `yaml:"commercials"`
+	Loudness      []*LoudnessSettings   `yaml:"loudness"`
+	Tags          TagSettings           `yaml:"id3"`
+	Resources     ResourceSettings      `yaml:"resources"`
+	Schedule      []*ScheduleWindow     `yaml:"schedule"`
+	Priorities    []*PriorityRule       `yaml:"priorities"`
+	DiskGuard     DiskGuardSettings     `yaml:"disk_guard"`
+	API           APISettings           `yaml:"api"`
+	Recordings    RecordingSettings     `yaml:"recordings"`
 }
 
 type TranscodeSettings struct {
-	Audio string `yaml:"audio"`
-	Video string `yaml:"video"`
+	Audio    string           `yaml:"audio"`
+	Video    string           `yaml:"video"`
+	Adaptive AdaptiveSettings `yaml:"adaptive"`
+}
+
+// Checks made on the transcoded output before the original recording is
+// removed. Size ratios are output size / input size, zero disables the check.
+type VerifySettings struct {
+	Enabled           bool    `yaml:"enabled"`
+	DurationTolerance float64 `yaml:"duration_tolerance"`
+	MinSizeRatio      float64 `yaml:"min_size_ratio"`
+	MaxSizeRatio      float64 `yaml:"max_size_ratio"`
+}
+
+// Where originals go instead of being deleted. Leaving the path empty
+// deletes them immediately as before.
+type TrashSettings struct {
+	Path      string        `yaml:"path"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+// Output path templates per media type, relative to Root. Fields are
+// written as {Title}, {Channel}, {Description}, {Filename}, {date}, {time}
+// and {year}. An empty template keeps the output next to the original.
+// A profile's output_template takes priority over these.
+type OutputSettings struct {
+	Root          string `yaml:"root"`
+	VideoTemplate string `yaml:"video_template"`
+	AudioTemplate string `yaml:"audio_template"`
+}
+
+// Kodi/Jellyfin .nfo sidecars for video outputs, optionally with a
+// thumbnail grabbed from ThumbnailOffset into the recording.
+type NFOSettings struct {
+	Enabled         bool          `yaml:"enabled"`
+	Thumbnail       bool          `yaml:"thumbnail"`
+	ThumbnailOffset time.Duration `yaml:"thumbnail_offset"`
 }
 
 type Person struct {
@@ -70,6 +122,59 @@ func (this *Config) Load(path string) error {
 		}
 	}
 
+	if err := this.Recordings.Prepare(); err != nil {
+		return err
+	}
+
+	if err := this.API.Prepare(); err != nil {
+		return err
+	}
+
+	if err := this.DiskGuard.Prepare(); err != nil {
+		return err
+	}
+
+	if err := this.Resources.Prepare(); err != nil {
+		return err
+	}
+
+	if err := this.TCSettings.Adaptive.Prepare(); err != nil {
+		return err
+	}
+
+	for i := range this.Commercials {
+		if err := this.Commercials[i].Prepare(); err != nil {
+			return fmt.Errorf("Commercial detection settings: %v", err)
+		}
+	}
+
+	for i := range this.Loudness {
+		if err := this.Loudness[i].Prepare(); err != nil {
+			return fmt.Errorf("Loudness settings: %v", err)
+		}
+	}
+
+	for i := range this.Priorities {
+		if err := this.Priorities[i].Prepare(); err != nil {
+			return err
+		}
+	}
+
+	for i := range this.Schedule {
+		if err := this.Schedule[i].Prepare(); err != nil {
+			return err
+		}
+	}
+
+	for i := range this.Profiles {
+		if this.Profiles[i].Name == "" {
+			this.Profiles[i].Name = fmt.Sprintf("profile%d", i+1)
+		}
+		if err := this.Profiles[i].Prepare(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The dashboard is a single page talking to the JSON API, built in so it
+// works without anything from the internet.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+func DashboardFS() http.FileSystem {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		Log.Fatalf("Dashboard files missing: %v", err)
+	}
+	return http.FS(sub)
+}
+
+// The running job, its progress and the queue in the order it'll run, for
+// GET /queue.
+func (this *Database) QueueDetail() (*JobRecord, Progress, []*JobRecord, error) {
+	id, progress, ids := QueueSnapshot()
+	states := JobStates()
+
+	var running *JobRecord
+	if id != 0 {
+		var err error
+		if running, err = this.Job(id, states); err != nil {
+			return nil, progress, nil, err
+		}
+	}
+	queued := make([]*JobRecord, 0, len(ids))
+	for _, qid := range ids {
+		r, err := this.Job(qid, states)
+		if err != nil {
+			return nil, progress, nil, err
+		}
+		if r != nil {
+			queued = append(queued, r)
+		}
+	}
+	return running, progress, queued, nil
+}
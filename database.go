@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -48,28 +50,149 @@ func (this *Database) Initialise() {
 					elapsedtime INTEGER, initialqueuetime DATETIME, 
 					completetime DATETIME, sizebefore INTEGER, sizeafter INTEGER);`
 
+	// Originals that have been moved to the trash directory rather than
+	// deleted outright.
+	trash_stmt := `CREATE TABLE IF NOT EXISTS trash (
+				   id INTEGER NOT NULL PRIMARY KEY, jobid INTEGER,
+				   originalpath TEXT, trashpath TEXT, outputpath TEXT,
+				   trashedtime DATETIME, expires DATETIME, state TEXT);`
+
+	// Outcome of each post-processing step run for a job.
+	poststeps_stmt := `CREATE TABLE IF NOT EXISTS poststeps (
+					   id INTEGER NOT NULL PRIMARY KEY, jobid INTEGER,
+					   name TEXT, type TEXT, success INTEGER, output TEXT,
+					   starttime DATETIME, elapsedtime INTEGER);`
+
+	// Advert breaks found by commercial detection, kept so false
+	// positives can be reviewed.
+	commercials_stmt := `CREATE TABLE IF NOT EXISTS commercials (
+						 id INTEGER NOT NULL PRIMARY KEY, jobid INTEGER,
+						 detector TEXT, start REAL, end REAL);`
+
+	// Extra outputs made alongside the main one.
+	renditions_stmt := `CREATE TABLE IF NOT EXISTS renditions (
+						id INTEGER NOT NULL PRIMARY KEY, jobid INTEGER,
+						name TEXT, outputpath TEXT, size INTEGER, success INTEGER,
+						message TEXT, elapsedtime INTEGER);`
+
 	if this.db == nil {
 		this.Open()
 	}
 	if _, err := this.db.Exec(create_stmt); err != nil {
 		Log.Fatalf("Could not create database table: %v", err)
 	}
+	if _, err := this.db.Exec(trash_stmt); err != nil {
+		Log.Fatalf("Could not create trash table: %v", err)
+	}
+	if _, err := this.db.Exec(poststeps_stmt); err != nil {
+		Log.Fatalf("Could not create post-processing table: %v", err)
+	}
+	if _, err := this.db.Exec(commercials_stmt); err != nil {
+		Log.Fatalf("Could not create commercials table: %v", err)
+	}
+	if _, err := this.db.Exec(renditions_stmt); err != nil {
+		Log.Fatalf("Could not create renditions table: %v", err)
+	}
+	if err := this.migrate(); err != nil {
+		Log.Fatalf("Could not update database schema: %v", err)
+	}
+	for _, col := range []string{"idempotencykey", "fingerprint", "outputpath", "path"} {
+		if _, err := this.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS transcodes_%v ON transcodes(%v)", col, col)); err != nil {
+			Log.Fatalf("Could not create index on %v: %v", col, err)
+		}
+	}
 
 	return
 }
 
+// Columns that have been added to the transcodes table since it was first
+// created. Anything missing from an existing database gets added on startup,
+// and backfill, if set, is run along with it to fill in existing rows.
+var transcodeColumns = []struct {
+	name     string
+	def      string
+	backfill string
+}{
+	// Before this we only kept the new size for transcodes that worked
+	{"success", "INTEGER NOT NULL DEFAULT 0", "UPDATE transcodes SET success=1 WHERE completed=1 AND sizeafter > 0"},
+	{"outputpath", "TEXT", ""},
+	{"encodeparams", "TEXT", ""},
+	{"loudnessi", "REAL", ""},
+	{"loudnesstp", "REAL", ""},
+	{"loudnesslra", "REAL", ""},
+	{"loudnessthresh", "REAL", ""},
+	{"priority", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"temppaths", "TEXT", ""},
+	{"duration", "REAL", ""},
+	{"starttime", "DATETIME", ""},
+	{"idempotencykey", "TEXT", ""},
+	{"fingerprint", "TEXT", ""},
+}
+
+func (this *Database) migrate() error {
+	rows, err := this.db.Query("PRAGMA table_info(transcodes)")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt interface{}
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, col := range transcodeColumns {
+		if existing[col.name] {
+			continue
+		}
+		Log.Info("Adding column '%v' to transcodes table", col.name)
+		tx, err := this.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE transcodes ADD COLUMN %v %v", col.name, col.def)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if col.backfill != "" {
+			res, err := tx.Exec(col.backfill)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Error filling in column '%v': %v", col.name, err)
+			}
+			n, _ := res.RowsAffected()
+			Log.Info("Filled in '%v' for %v existing jobs", col.name, n)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Add a new job to the database.
 func (this *Database) AddEntry(t *TVHJob) (int64, error) {
 	Log.Debug("Adding database entry for job: %+v", t)
 	stmt, err := this.db.Prepare(`INSERT INTO transcodes (path, filename, channel, title, status, description, 
 								  completed, message, elapsedtime, initialqueuetime, completetime, 
-								  sizebefore, sizeafter) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
+								  sizebefore, sizeafter, priority, idempotencykey, fingerprint)
+								  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
 	if err != nil {
 		return -1, fmt.Errorf("Error creating prepared statement: %v", err)
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(t.Path, t.Filename, t.Channel, t.Title, t.Status, t.Description, false, "", 0, time.Now(), nil, 0, 0)
+	res, err := stmt.Exec(t.Path, t.Filename, t.Channel, t.Title, t.Status, t.Description, false, "", 0, time.Now(), nil, 0, 0, t.Priority,
+		t.IdempotencyKey, t.Fingerprint)
 	if err != nil {
 		return -1, fmt.Errorf("Could not add job to database: %v", err)
 	}
@@ -85,13 +208,38 @@ func (this *Database) AddEntry(t *TVHJob) (int64, error) {
 // Mark a job as completed.
 func (this *Database) Complete(t *TranscodeJob) error {
 	Log.Debug("Completing database entry for job: %+v", t.Job)
-	stmt, err := this.db.Prepare(`UPDATE transcodes SET completed=?, message=?, elapsedtime=?, completetime=?,
-								  sizebefore=?, sizeafter=? WHERE id=?`)
+	stmt, err := this.db.Prepare(`UPDATE transcodes SET completed=?, success=?, message=?, elapsedtime=?, completetime=?,
+								  sizebefore=?, sizeafter=?, outputpath=?, encodeparams=?, loudnessi=?,
+								  loudnesstp=?, loudnesslra=?, loudnessthresh=?, duration=? WHERE id=?`)
 	if err != nil {
 		return fmt.Errorf("Error creating prepared statement: %v", err)
 	}
 
-	_, err = stmt.Exec(true, t.Message, t.ElapsedTime.Nanoseconds(), time.Now(), t.OldSize, t.NewSize, t.Job.DBID)
+	// Failed jobs don't leave an output behind
+	output := ""
+	if t.Success {
+		output = t.OutputPath
+	}
+
+	encode := ""
+	if t.Encode != nil {
+		encode = t.Encode.String()
+	}
+
+	// Left NULL when there was no loudness analysis
+	var li, ltp, llra, lthresh interface{}
+	if t.Loudness != nil {
+		li, ltp, llra, lthresh = t.Loudness.InputI, t.Loudness.InputTP, t.Loudness.InputLRA, t.Loudness.InputThresh
+	}
+
+	// Length of the recording, for working out transcode speed
+	var duration interface{}
+	if t.SourceProbe != nil && t.SourceProbe.Duration() > 0 {
+		duration = t.SourceProbe.Duration()
+	}
+
+	_, err = stmt.Exec(true, t.Success, t.Message, t.ElapsedTime.Nanoseconds(), time.Now(), t.OldSize, t.NewSize, output, encode,
+		li, ltp, llra, lthresh, duration, t.Job.DBID)
 	if err != nil {
 		return fmt.Errorf("Error completing job: %v", err)
 	}
@@ -99,25 +247,179 @@ func (this *Database) Complete(t *TranscodeJob) error {
 	return nil
 }
 
+// Record the outcome of a post-processing step.
+func (this *Database) AddPostStepResult(jobID int64, r PostStepResult) error {
+	_, err := this.db.Exec(`INSERT INTO poststeps (jobid, name, type, success, output, starttime, elapsedtime)
+							VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		jobID, r.Name, r.Type, r.Success, r.Output, r.Started, r.Elapsed.Nanoseconds())
+	if err != nil {
+		return fmt.Errorf("Could not record post-processing result: %v", err)
+	}
+	return nil
+}
+
+// Record the outcome of a rendition.
+func (this *Database) AddRendition(jobID int64, r *Rendition) error {
+	output := ""
+	if r.Success {
+		output = r.OutputPath
+	}
+	_, err := this.db.Exec(`INSERT INTO renditions (jobid, name, outputpath, size, success, message, elapsedtime)
+							VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		jobID, r.Name, output, r.Size, r.Success, r.Message, r.Elapsed.Nanoseconds())
+	if err != nil {
+		return fmt.Errorf("Could not record rendition: %v", err)
+	}
+	return nil
+}
+
+// Record the commercial breaks detected for a job, replacing any from an
+// earlier attempt.
+func (this *Database) SetCommercials(jobID int64, detector string, segments []Segment) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Could not start transaction: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM commercials WHERE jobid=?", jobID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Could not clear old commercials: %v", err)
+	}
+	for _, s := range segments {
+		if _, err := tx.Exec("INSERT INTO commercials (jobid, detector, start, end) VALUES (?, ?, ?, ?)",
+			jobID, detector, s.Start, s.End); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Could not record commercial: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Mark a job that was taken off the queue as finished.
+func (this *Database) Cancel(jobID int64) error {
+	_, err := this.db.Exec("UPDATE transcodes SET completed=1, success=0, message=?, completetime=? WHERE id=? AND completed=0",
+		"Cancelled", time.Now(), jobID)
+	if err != nil {
+		return fmt.Errorf("Could not cancel job: %v", err)
+	}
+	return nil
+}
+
+// Mark a job that can't go ahead as failed, with the reason.
+func (this *Database) Fail(jobID int64, message string) error {
+	_, err := this.db.Exec("UPDATE transcodes SET completed=1, success=0, message=?, completetime=? WHERE id=?",
+		message, time.Now(), jobID)
+	if err != nil {
+		return fmt.Errorf("Could not fail job: %v", err)
+	}
+	return nil
+}
+
+// Reset a failed job so it can be queued again. Returns nil if there's no
+// failed job with that ID.
+func (this *Database) Retry(jobID int64) (*TVHJob, error) {
+	job := &TVHJob{}
+	err := this.db.QueryRow(`SELECT id, path, filename, channel, title, status, description, priority
+							 FROM transcodes WHERE id=? AND completed=1 AND success=0`, jobID).
+		Scan(&job.DBID, &job.Path, &job.Filename, &job.Channel, &job.Title, &job.Status, &job.Description, &job.Priority)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving job: %v", err)
+	}
+	_, err = this.db.Exec(`UPDATE transcodes SET completed=0, message='', completetime=NULL, starttime=NULL,
+						   temppaths=NULL WHERE id=?`, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not reset job: %v", err)
+	}
+	return job, nil
+}
+
+// Note when a job comes off the queue and starts.
+func (this *Database) Started(jobID int64) error {
+	if _, err := this.db.Exec("UPDATE transcodes SET starttime=? WHERE id=?", time.Now(), jobID); err != nil {
+		return fmt.Errorf("Could not record start time: %v", err)
+	}
+	return nil
+}
+
+// Record where a job is writing its temporary outputs, one path per line,
+// so they can be cleaned up if we die part way through.
+func (this *Database) SetTempPaths(jobID int64, paths []string) error {
+	if _, err := this.db.Exec("UPDATE transcodes SET temppaths=? WHERE id=?", strings.Join(paths, "\n"), jobID); err != nil {
+		return fmt.Errorf("Could not record temporary paths: %v", err)
+	}
+	return nil
+}
+
+// Change the priority of a job.
+func (this *Database) SetPriority(jobID int64, priority int) error {
+	if _, err := this.db.Exec("UPDATE transcodes SET priority=? WHERE id=?", priority, jobID); err != nil {
+		return fmt.Errorf("Could not update priority: %v", err)
+	}
+	return nil
+}
+
+func (this *Database) Commercials(jobID int64) ([]Segment, error) {
+	rows, err := this.db.Query("SELECT start, end FROM commercials WHERE jobid=? ORDER BY start", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	segments := make([]Segment, 0)
+	for rows.Next() {
+		s := Segment{}
+		if err := rows.Scan(&s.Start, &s.End); err != nil {
+			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		segments = append(segments, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error retrieving commercials: %v", err)
+	}
+	return segments, nil
+}
+
 // Recover any uncompleted jobs from the database
-// and add them back onto the transcode queue
+// and add them back onto the transcode queue. Ones whose original has gone
+// got as far as removing it, so they're failed for a human to look at
+// rather than run again.
 func (this *Database) Recover() error {
 	Log.Debug("Doing job recovery...")
 
-	rows, err := this.db.Query("SELECT id, path, filename, channel, title, status, description FROM transcodes WHERE completed=0")
+	rows, err := this.db.Query(`SELECT id, path, filename, channel, title, status, description, priority,
+								IFNULL(temppaths, '') FROM transcodes WHERE completed=0`)
 	if err != nil {
 		return fmt.Errorf("Error querying database: %v", err)
 	}
 	defer rows.Close()
 
+	// Failed once we're done reading, sqlite won't write in the meantime
+	type failure struct {
+		id      int64
+		message string
+	}
+	failed := make([]failure, 0)
 	i := 0
 	for rows.Next() {
 		job := &TVHJob{}
+		var temps string
 		//err := rows.Scan(&path, &filename, &channel, &title, &status)
-		err := rows.Scan(&job.DBID, &job.Path, &job.Filename, &job.Channel, &job.Title, &job.Status, &job.Description)
+		err := rows.Scan(&job.DBID, &job.Path, &job.Filename, &job.Channel, &job.Title, &job.Status, &job.Description, &job.Priority, &temps)
 		if err != nil {
 			return fmt.Errorf("Error retrieving row from database: %v", err)
 		}
+		if _, err := os.Stat(job.Path); err != nil && job.Status == "OK" {
+			msg := "Original went missing while the job was interrupted, needs manual attention."
+			if kept := keptOutputs(temps); len(kept) > 0 {
+				msg += fmt.Sprintf(" Output kept at %v", strings.Join(kept, ", "))
+			}
+			Log.Warning("Job %v: %v", job.DBID, msg)
+			failed = append(failed, failure{job.DBID, msg})
+			continue
+		}
+		removeStaleOutputs(job, temps)
 		Transcode(job)
 		i++
 	}
@@ -125,6 +427,13 @@ func (this *Database) Recover() error {
 	if err != nil {
 		return fmt.Errorf("Error during recovery: %v", err)
 	}
+	rows.Close()
+
+	for _, f := range failed {
+		if err := this.Fail(f.id, f.message); err != nil {
+			Log.Error(err.Error())
+		}
+	}
 
 	Log.Warning("Recovered %v incomplete jobs", i)
 
@@ -135,7 +444,7 @@ func (this *Database) IncompleteJobs() ([]TVHJob, error) {
 	Log.Debug("Getting incomplete job list...")
 	jobs := make([]TVHJob, 0)
 
-	rows, err := this.db.Query("SELECT id, path, filename, channel, title, status, description FROM transcodes WHERE completed=0")
+	rows, err := this.db.Query("SELECT id, path, filename, channel, title, status, description, priority FROM transcodes WHERE completed=0")
 	if err != nil {
 		return nil, fmt.Errorf("Error querying database: %v", err)
 	}
@@ -143,7 +452,7 @@ func (this *Database) IncompleteJobs() ([]TVHJob, error) {
 
 	for rows.Next() {
 		job := TVHJob{}
-		err := rows.Scan(&job.DBID, &job.Path, &job.Filename, &job.Channel, &job.Title, &job.Status, &job.Description)
+		err := rows.Scan(&job.DBID, &job.Path, &job.Filename, &job.Channel, &job.Title, &job.Status, &job.Description, &job.Priority)
 		if err != nil {
 			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
 		}
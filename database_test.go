@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// A database of our own in a temporary directory, with the schema in place
+// unless it's given a pre-existing one to start from.
+func testDatabase(t *testing.T, setup ...string) *Database {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "tvhtc.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, stmt := range setup {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%v: %v", stmt, err)
+		}
+	}
+	d := &Database{db: db}
+	d.Initialise()
+	return d
+}
+
+func TestMigrateAddsColumns(t *testing.T) {
+	legacy := `CREATE TABLE transcodes (
+		id INTEGER NOT NULL PRIMARY KEY, path TEXT,
+		filename TEXT, channel TEXT, title TEXT,
+		status TEXT, description TEXT, completed INTEGER, message TEXT,
+		elapsedtime INTEGER, initialqueuetime DATETIME,
+		completetime DATETIME, sizebefore INTEGER, sizeafter INTEGER);`
+
+	tests := []struct {
+		name  string
+		setup []string
+	}{
+		{"new database", nil},
+		{"existing database", []string{legacy, "INSERT INTO transcodes (id, completed) VALUES (1, 1)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDatabase(t, tt.setup...)
+			// Running it again on an up to date schema is a no-op
+			if err := d.migrate(); err != nil {
+				t.Fatal(err)
+			}
+			for _, col := range transcodeColumns {
+				if _, err := d.db.Exec(fmt.Sprintf("SELECT %v FROM transcodes", col.name)); err != nil {
+					t.Errorf("column %v: %v", col.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateBackfillsSuccess(t *testing.T) {
+	legacy := []string{
+		`CREATE TABLE transcodes (
+			id INTEGER NOT NULL PRIMARY KEY, path TEXT,
+			filename TEXT, channel TEXT, title TEXT,
+			status TEXT, description TEXT, completed INTEGER, message TEXT,
+			elapsedtime INTEGER, initialqueuetime DATETIME,
+			completetime DATETIME, sizebefore INTEGER, sizeafter INTEGER);`,
+		`INSERT INTO transcodes (id, completed, sizebefore, sizeafter) VALUES
+			(1, 1, 1000, 400),
+			(2, 1, 1000, 0),
+			(3, 0, 1000, 0),
+			(4, 1, 0, 0);`,
+	}
+	d := testDatabase(t, legacy...)
+
+	tests := []struct {
+		id      int
+		success bool
+	}{
+		{1, true},
+		{2, false},
+		{3, false},
+		{4, false},
+	}
+	for _, tt := range tests {
+		var success bool
+		if err := d.db.QueryRow("SELECT success FROM transcodes WHERE id=?", tt.id).Scan(&success); err != nil {
+			t.Fatal(err)
+		}
+		if success != tt.success {
+			t.Errorf("job %v: success = %v, want %v", tt.id, success, tt.success)
+		}
+	}
+
+	// Running it again mustn't touch anything
+	d.db.Exec("UPDATE transcodes SET success=0 WHERE id=1")
+	if err := d.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	var success bool
+	d.db.QueryRow("SELECT success FROM transcodes WHERE id=1").Scan(&success)
+	if success {
+		t.Error("backfill ran again on an up to date schema")
+	}
+}
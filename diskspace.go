@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Used when check_interval isn't set in the config.
+const defaultDiskCheckInterval = 5 * time.Minute
+
+// Hold the queue rather than start a transcode that would leave less than
+// MinFree (e.g. "20GiB") on the filesystem it writes to. EstimateRatio is
+// the expected output size as a fraction of the recording's, used when
+// there's no bitrate to work it out from.
+type DiskGuardSettings struct {
+	MinFree       string        `yaml:"min_free"`
+	EstimateRatio float64       `yaml:"estimate_ratio"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	minFree       uint64
+}
+
+func (this *DiskGuardSettings) Prepare() error {
+	if this.MinFree != "" {
+		var err error
+		if this.minFree, err = humanize.ParseBytes(this.MinFree); err != nil {
+			return fmt.Errorf("Invalid min_free '%v': %v", this.MinFree, err)
+		}
+	}
+	if this.EstimateRatio <= 0 {
+		this.EstimateRatio = 1
+	}
+	if this.CheckInterval <= 0 {
+		this.CheckInterval = defaultDiskCheckInterval
+	}
+	return nil
+}
+
+// Free space available to us on the filesystem holding path.
+func freeSpace(path string) (uint64, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// Rough size of everything the transcode will write, from the probed
+// duration and whatever bitrate we know the output will have.
+func (this *TranscodeJob) EstimateOutputSize() int64 {
+	ratio := this.Conf.DiskGuard.EstimateRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+
+	var size, estimate int64
+	duration := 0.0
+	if src, err := this.ProbeSource(); err == nil {
+		size, _ = strconv.ParseInt(src.Format.Size, 10, 64)
+		duration = this.ExpectedDuration()
+	}
+	if size <= 0 {
+		if st, err := os.Stat(this.Job.Path); err == nil {
+			size = st.Size()
+		}
+	}
+	estimate = int64(float64(size) * ratio)
+
+	if duration > 0 {
+		if as := this.adaptiveSettings(); as != nil {
+			estimate = int64(float64(as.budget()) * duration / 8)
+		} else if this.Type == MEDIA_AUDIO {
+			opts := strings.Split(this.Conf.TCSettings.Audio, " ")
+			if b, err := parseBitrate(optionValue(opts, "-b:a")); err == nil && b > 0 {
+				estimate = int64(float64(b) * duration / 8)
+			}
+		}
+	}
+
+	// Renditions are guessed at the same size, better to overestimate
+	outputs := 1
+	if this.Profile != nil {
+		outputs += len(this.Profile.Renditions)
+	}
+	return estimate * int64(outputs)
+}
+
+// The nearest directory at or above dir that exists, as output
+// directories from a template aren't created until the transcode starts.
+func existingAncestor(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// Directories on the filesystems the transcode will write to: wherever the
+// output ends up and the scratch directory, if there is one. Works it out
+// without choosing the output's name, which waits for Transcode().
+func (this *TranscodeJob) outputDirs() ([]string, error) {
+	if err := this.DetermineType(); err != nil {
+		return nil, err
+	}
+	this.Profile = this.Conf.ProfileFor(this.Job, this.Type)
+
+	dir := filepath.Dir(this.Job.Path)
+	if out := this.TemplatedOutputPath(); out != "" {
+		dir = filepath.Dir(out)
+	}
+	dirs := []string{existingAncestor(dir)}
+	if this.Conf.ScratchDir != "" {
+		dirs = append(dirs, existingAncestor(this.Conf.ScratchDir))
+	}
+	return dirs, nil
+}
+
+// Check there's room for the output on the filesystems it'll be written to.
+// Failed recordings don't write anything so always pass.
+func (this *TranscodeJob) CheckDiskSpace() error {
+	dg := &this.Conf.DiskGuard
+	if dg.minFree == 0 || this.Job.Status != "OK" {
+		return nil
+	}
+	st, err := os.Stat(this.Job.Path)
+	if err != nil {
+		// Transcode() will complain about this
+		return nil
+	}
+	// Output templates can use the recording time
+	this.OldSize = st.Size()
+	this.RecordedAt = st.ModTime()
+
+	dirs, err := this.outputDirs()
+	if err != nil {
+		return nil
+	}
+	need := uint64(this.EstimateOutputSize())
+	for _, dir := range dirs {
+		free, err := freeSpace(dir)
+		if err != nil {
+			Log.Warning("Unable to check free space on %v: %v", dir, err)
+			continue
+		}
+		Log.Debug("Free space on %v: %v, estimated output for '%v': %v", dir, humanize.IBytes(free), this.Job.Title, humanize.IBytes(need))
+		if free < need+dg.minFree {
+			return fmt.Errorf("Only %v free on %v, '%v' needs about %v plus %v kept free",
+				humanize.IBytes(free), dir, this.Job.Title, humanize.IBytes(need), humanize.IBytes(dg.minFree))
+		}
+	}
+	return nil
+}
+
+// Whether the queue is held for lack of space, so we only alert once.
+type diskHold struct {
+	sync.Mutex
+	held   bool
+	reason string
+}
+
+var diskGuard = &diskHold{}
+
+func (this *diskHold) hold(conf *Config, reason error) {
+	this.Lock()
+	first := !this.held
+	this.held, this.reason = true, reason.Error()
+	this.Unlock()
+
+	if first {
+		Log.Warning("Holding the queue: %v", reason)
+		conf.SendAlert("Low disk space", fmt.Sprintf("Transcoding is on hold until space is freed up. %v", reason))
+	}
+}
+
+func (this *diskHold) release(conf *Config) {
+	this.Lock()
+	was := this.held
+	this.held, this.reason = false, ""
+	this.Unlock()
+
+	if was {
+		Log.Warning("Disk space available again, resuming the queue.")
+		conf.SendAlert("Disk space recovered", "Transcoding has resumed.")
+	}
+}
+
+func (this *diskHold) isHeld() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.held
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOutputDirs(t *testing.T) {
+	base := t.TempDir()
+	recordings := filepath.Join(base, "recordings")
+	library := filepath.Join(base, "library")
+	scratch := filepath.Join(base, "scratch")
+	for _, dir := range []string{recordings, library, scratch} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorded := time.Date(2019, 3, 2, 20, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		tmpl    string
+		scratch string
+		want    []string
+	}{
+		{"next to the recording", "", "", []string{recordings}},
+		{"template directory not made yet", "TV/{Title}/{year}/{Title}.mkv", "", []string{library}},
+		{"with scratch", "", scratch, []string{recordings, scratch}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := NewConfig()
+			conf.Output.Root = library
+			conf.Output.VideoTemplate = tt.tmpl
+			conf.ScratchDir = tt.scratch
+			job := &TVHJob{Path: filepath.Join(recordings, "news.ts"), Filename: "news.ts", Title: "News"}
+			tc := &TranscodeJob{Job: job, Conf: &conf, RecordedAt: recorded}
+			got, err := tc.outputDirs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tc.TempPath != "" || tc.OutputPath != "" {
+				t.Errorf("output named early: %q, %q", tc.TempPath, tc.OutputPath)
+			}
+		})
+	}
+}
@@ -7,5 +7,42 @@ type TVHJob struct {
 	Title       string `json:"title"`
 	Status      string `json:"status"`
 	Description string `json:"description"`
-	DBID        int64  `json:"-"`
+	// As given in the payload, nil if it was left to the priority rules
+	RequestedPriority *int `json:"priority,omitempty"`
+	Priority          int  `json:"-"`
+	// Sent by clients so a resubmission is recognised
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	Fingerprint    string `json:"-"`
+	DBID           int64  `json:"-"`
+}
+
+// A job as listed by /incompletejobs and /recentcompleted. TVHJob is what
+// comes in, this is what goes out, so neither can leak into the other.
+type JobSummary struct {
+	ID          int64  `json:"id"`
+	Path        string `json:"path"`
+	Filename    string `json:"fname"`
+	Channel     string `json:"channel"`
+	Title       string `json:"title"`
+	Status      string `json:"status"`
+	Description string `json:"description"`
+	Priority    int    `json:"priority"`
+	QueueState  string `json:"queue_state,omitempty"`
+}
+
+func NewJobSummaries(jobs []TVHJob) []JobSummary {
+	summaries := make([]JobSummary, len(jobs))
+	for i, job := range jobs {
+		summaries[i] = JobSummary{
+			ID:          job.DBID,
+			Path:        job.Path,
+			Filename:    job.Filename,
+			Channel:     job.Channel,
+			Title:       job.Title,
+			Status:      job.Status,
+			Description: job.Description,
+			Priority:    job.Priority,
+		}
+	}
+	return summaries
 }
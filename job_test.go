@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTVHJobIgnoresResponseFields(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"id", `{"path": "/r/a.ts", "id": 42}`},
+		{"queue state", `{"path": "/r/a.ts", "queue_state": "running"}`},
+		{"fingerprint", `{"path": "/r/a.ts", "Fingerprint": "abc"}`},
+	}
+	for _, tt := range tests {
+		job := TVHJob{}
+		if err := json.Unmarshal([]byte(tt.body), &job); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if job.DBID != 0 || job.Fingerprint != "" {
+			t.Errorf("%v: picked up %+v", tt.name, job)
+		}
+	}
+}
+
+func TestNewJobSummaries(t *testing.T) {
+	jobs := []TVHJob{{Path: "/r/a.ts", Filename: "a.ts", Title: "A", Priority: 3, DBID: 9, Fingerprint: "x"}}
+	raw, err := json.Marshal(NewJobSummaries(jobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"id":9,"path":"/r/a.ts","fname":"a.ts","channel":"","title":"A","status":"","description":"","priority":3}]`
+	if string(raw) != want {
+		t.Errorf("got %v, want %v", string(raw), want)
+	}
+}
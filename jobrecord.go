@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States of finished jobs. Jobs that haven't finished have their queue
+// state (queued, running...).
+const (
+	JOB_SUCCEEDED  = "succeeded"
+	JOB_FAILED     = "failed"
+	JOB_INCOMPLETE = "incomplete"
+)
+
+const (
+	defaultJobsLimit = 50
+	maxJobsLimit     = 500
+)
+
+// A job as returned by the API. Fields are only ever added to this, so
+// anything reading it can rely on it.
+type JobRecord struct {
+	ID           int64            `json:"id"`
+	State        string           `json:"state"`
+	Path         string           `json:"path"`
+	Filename     string           `json:"filename"`
+	Channel      string           `json:"channel"`
+	Title        string           `json:"title"`
+	Description  string           `json:"description"`
+	RecordStatus string           `json:"recording_status"`
+	Priority     int              `json:"priority"`
+	Completed    bool             `json:"completed"`
+	Success      bool             `json:"success"`
+	Message      string           `json:"message"`
+	OutputPath   string           `json:"output_path"`
+	SizeBefore   int64            `json:"size_before"`
+	SizeAfter    int64            `json:"size_after"`
+	Elapsed      time.Duration    `json:"elapsed"`
+	QueuedAt     time.Time        `json:"queued_at"`
+	CompletedAt  *time.Time       `json:"completed_at"`
+	EncodeParams string           `json:"encode_params"`
+	Loudness     *float64         `json:"loudness_i"`
+	Renditions   []Rendition      `json:"renditions,omitempty"`
+	PostSteps    []PostStepResult `json:"post_steps,omitempty"`
+	Commercials  []Segment        `json:"commercials,omitempty"`
+}
+
+// Filters, sorting and paging for a job query. Empty fields don't filter.
+type JobQuery struct {
+	State   string
+	Channel string
+	Title   string
+	Success *bool
+	From    time.Time
+	To      time.Time
+	Sort    string
+	Asc     bool
+	Limit   int
+	Cursor  string
+}
+
+// Dates in queries can be either RFC 3339 or just the day.
+func parseQueryTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("Invalid date '%v', expected YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// Build a query from the parameters of a GET /jobs request.
+func ParseJobQuery(params url.Values) (JobQuery, error) {
+	q := JobQuery{
+		State:   params.Get("state"),
+		Channel: params.Get("channel"),
+		Title:   params.Get("title"),
+		Sort:    params.Get("sort"),
+		Cursor:  params.Get("cursor"),
+	}
+	var err error
+	if s := params.Get("success"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, fmt.Errorf("Invalid success '%v'", s)
+		}
+		q.Success = &b
+	}
+	if s := params.Get("from"); s != "" {
+		if q.From, err = parseQueryTime(s); err != nil {
+			return q, err
+		}
+	}
+	if s := params.Get("to"); s != "" {
+		if q.To, err = parseQueryTime(s); err != nil {
+			return q, err
+		}
+	}
+	switch params.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Asc = true
+	default:
+		return q, fmt.Errorf("Order must be 'asc' or 'desc'")
+	}
+	if s := params.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("Invalid limit '%v'", s)
+		}
+	}
+	if _, ok := jobSortKeys[q.Sort]; q.Sort != "" && !ok {
+		return q, fmt.Errorf("Unknown sort key '%v'", q.Sort)
+	}
+	if !validJobState(q.State) {
+		return q, fmt.Errorf("Unknown state '%v'", q.State)
+	}
+	if q.Cursor != "" {
+		if _, _, err := decodeCursor(q.Cursor); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// Sort keys the API accepts and the expression each sorts by. Queue order
+// is ID order.
+var jobSortKeys = map[string]string{
+	"queued":      "id",
+	"completed":   "IFNULL(julianday(completetime), 0)",
+	"title":       "LOWER(title)",
+	"channel":     "LOWER(channel)",
+	"priority":    "priority",
+	"size_before": "sizebefore",
+	"size_after":  "sizeafter",
+	"elapsed":     "elapsedtime",
+}
+
+const jobColumns = `id, path, filename, channel, title, IFNULL(description, ''), status, priority,
+					completed, success, IFNULL(message, ''), IFNULL(outputpath, ''), sizebefore, sizeafter,
+					elapsedtime, initialqueuetime, completetime, IFNULL(encodeparams, ''), loudnessi`
+
+// Where we got to in a set of results: the sort value and ID of the last
+// job returned.
+type jobCursor struct {
+	Key json.RawMessage `json:"k"`
+	ID  int64           `json:"id"`
+}
+
+func encodeCursor(key interface{}, id int64) string {
+	k, _ := json.Marshal(key)
+	raw, _ := json.Marshal(jobCursor{Key: k, ID: id})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (interface{}, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid cursor")
+	}
+	c := jobCursor{}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, 0, fmt.Errorf("Invalid cursor")
+	}
+	dec := json.NewDecoder(strings.NewReader(string(c.Key)))
+	dec.UseNumber()
+	var key interface{}
+	if err := dec.Decode(&key); err != nil {
+		return nil, 0, fmt.Errorf("Invalid cursor")
+	}
+	// Keep integers as integers so SQLite compares them the same way
+	if n, ok := key.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			key = i
+		} else if f, err := n.Float64(); err == nil {
+			key = f
+		}
+	}
+	return key, c.ID, nil
+}
+
+func validJobState(state string) bool {
+	switch state {
+	case "", JOB_SUCCEEDED, JOB_FAILED, JOB_INCOMPLETE,
+		QUEUE_QUEUED, QUEUE_WAITING, QUEUE_RUNNING, QUEUE_PAUSED, QUEUE_NOSPACE:
+		return true
+	}
+	return false
+}
+
+// Fill in the state of an unfinished job from the queue.
+func (this *JobRecord) setState(queue map[int64]string) {
+	switch {
+	case this.Completed && this.Success:
+		this.State = JOB_SUCCEEDED
+	case this.Completed:
+		this.State = JOB_FAILED
+	case queue[this.ID] != "":
+		this.State = queue[this.ID]
+	default:
+		this.State = JOB_INCOMPLETE
+	}
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJobRecord(row scanner, extra ...interface{}) (*JobRecord, error) {
+	r := &JobRecord{}
+	var elapsed int64
+	dest := []interface{}{&r.ID, &r.Path, &r.Filename, &r.Channel, &r.Title, &r.Description, &r.RecordStatus,
+		&r.Priority, &r.Completed, &r.Success, &r.Message, &r.OutputPath, &r.SizeBefore, &r.SizeAfter,
+		&elapsed, &r.QueuedAt, &r.CompletedAt, &r.EncodeParams, &r.Loudness}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	r.Elapsed = time.Duration(elapsed)
+	return r, nil
+}
+
+// Search the jobs. Returns the page of jobs and the cursor for the next
+// page, which is "" if there isn't one.
+func (this *Database) Jobs(q JobQuery, queue map[int64]string) ([]*JobRecord, string, error) {
+	sortKey := q.Sort
+	if sortKey == "" {
+		sortKey = "queued"
+	}
+	key, ok := jobSortKeys[sortKey]
+	if !ok {
+		return nil, "", fmt.Errorf("Unknown sort key '%v'", q.Sort)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultJobsLimit
+	}
+	if limit > maxJobsLimit {
+		limit = maxJobsLimit
+	}
+
+	where := []string{"1=1"}
+	args := []interface{}{}
+	switch q.State {
+	case "":
+	case JOB_SUCCEEDED:
+		where = append(where, "completed=1 AND success=1")
+	case JOB_FAILED:
+		where = append(where, "completed=1 AND success=0")
+	case JOB_INCOMPLETE:
+		where = append(where, "completed=0")
+	case QUEUE_QUEUED, QUEUE_WAITING, QUEUE_RUNNING, QUEUE_PAUSED, QUEUE_NOSPACE:
+		ids := []string{"-1"}
+		for id, state := range queue {
+			if state == q.State {
+				ids = append(ids, fmt.Sprintf("%d", id))
+			}
+		}
+		where = append(where, fmt.Sprintf("completed=0 AND id IN (%v)", strings.Join(ids, ",")))
+	default:
+		return nil, "", fmt.Errorf("Unknown state '%v'", q.State)
+	}
+	if q.Channel != "" {
+		where = append(where, "channel = ? COLLATE NOCASE")
+		args = append(args, q.Channel)
+	}
+	if q.Title != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q.Title)
+		where = append(where, `title LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escaped+"%")
+	}
+	if q.Success != nil {
+		where = append(where, "completed=1 AND success=?")
+		args = append(args, *q.Success)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "julianday(initialqueuetime) >= julianday(?)")
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		where = append(where, "julianday(initialqueuetime) < julianday(?)")
+		args = append(args, q.To)
+	}
+
+	dir, cmp := "DESC", "<"
+	if q.Asc {
+		dir, cmp = "ASC", ">"
+	}
+	if q.Cursor != "" {
+		ck, cid, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, fmt.Sprintf("(%[1]v %[2]v ? OR (%[1]v = ? AND id %[2]v ?))", key, cmp))
+		args = append(args, ck, ck, cid)
+	}
+
+	stmt := fmt.Sprintf("SELECT %v, %v FROM transcodes WHERE %v ORDER BY %v %v, id %v LIMIT %d",
+		jobColumns, key, strings.Join(where, " AND "), key, dir, dir, limit+1)
+	rows, err := this.db.Query(stmt, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	jobs := make([]*JobRecord, 0)
+	var lastKey interface{}
+	next := ""
+	for rows.Next() {
+		var k interface{}
+		r, err := scanJobRecord(rows, &k)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		if b, ok := k.([]byte); ok {
+			k = string(b)
+		}
+		if len(jobs) == limit {
+			next = encodeCursor(lastKey, jobs[len(jobs)-1].ID)
+			break
+		}
+		r.setState(queue)
+		jobs = append(jobs, r)
+		lastKey = k
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("Error retrieving jobs: %v", err)
+	}
+	return jobs, next, nil
+}
+
+// A single job with everything we know about it, or nil if there's no
+// such job.
+func (this *Database) Job(id int64, queue map[int64]string) (*JobRecord, error) {
+	r, err := scanJobRecord(this.db.QueryRow(fmt.Sprintf("SELECT %v FROM transcodes WHERE id=?", jobColumns), id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving job: %v", err)
+	}
+	r.setState(queue)
+
+	if r.Renditions, err = this.Renditions(id); err != nil {
+		return nil, err
+	}
+	if r.PostSteps, err = this.PostStepResults(id); err != nil {
+		return nil, err
+	}
+	if r.Commercials, err = this.Commercials(id); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (this *Database) Renditions(jobID int64) ([]Rendition, error) {
+	rows, err := this.db.Query(`SELECT name, IFNULL(outputpath, ''), size, success, IFNULL(message, ''), elapsedtime
+								FROM renditions WHERE jobid=? ORDER BY id`, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	renditions := make([]Rendition, 0)
+	for rows.Next() {
+		r := Rendition{}
+		var elapsed int64
+		if err := rows.Scan(&r.Name, &r.OutputPath, &r.Size, &r.Success, &r.Message, &elapsed); err != nil {
+			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		r.Elapsed = time.Duration(elapsed)
+		renditions = append(renditions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error retrieving renditions: %v", err)
+	}
+	return renditions, nil
+}
+
+func (this *Database) PostStepResults(jobID int64) ([]PostStepResult, error) {
+	rows, err := this.db.Query(`SELECT name, type, success, IFNULL(output, ''), starttime, elapsedtime
+								FROM poststeps WHERE jobid=? ORDER BY id`, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	results := make([]PostStepResult, 0)
+	for rows.Next() {
+		r := PostStepResult{}
+		var elapsed int64
+		if err := rows.Scan(&r.Name, &r.Type, &r.Success, &r.Output, &r.Started, &elapsed); err != nil {
+			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		r.Elapsed = time.Duration(elapsed)
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error retrieving post-processing results: %v", err)
+	}
+	return results, nil
+}
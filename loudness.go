@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// EBU R128 defaults, used for any targets not set in the config.
+const (
+	defaultTargetI   = -23.0
+	defaultTargetTP  = -1.0
+	defaultTargetLRA = 7.0
+)
+
+// Loudness normalisation settings for a set of radio channels. The first
+// entry whose channel patterns match the recording is used.
+type LoudnessSettings struct {
+	Channels  []string `yaml:"channels"`
+	TargetI   float64  `yaml:"target_i"`
+	TargetTP  float64  `yaml:"target_tp"`
+	TargetLRA float64  `yaml:"target_lra"`
+	channels  []*regexp.Regexp
+}
+
+// Values measured by the loudnorm analysis pass.
+type Loudness struct {
+	InputI       float64 `json:"input_i"`
+	InputTP      float64 `json:"input_tp"`
+	InputLRA     float64 `json:"input_lra"`
+	InputThresh  float64 `json:"input_thresh"`
+	TargetOffset float64 `json:"target_offset"`
+}
+
+func (this *LoudnessSettings) Prepare() error {
+	var err error
+	if this.channels, err = compilePatterns(this.Channels); err != nil {
+		return err
+	}
+	if this.TargetI == 0 {
+		this.TargetI = defaultTargetI
+	}
+	if this.TargetTP == 0 {
+		this.TargetTP = defaultTargetTP
+	}
+	if this.TargetLRA == 0 {
+		this.TargetLRA = defaultTargetLRA
+	}
+	return nil
+}
+
+func (this *LoudnessSettings) targets() string {
+	return fmt.Sprintf("I=%.1f:TP=%.1f:LRA=%.1f", this.TargetI, this.TargetTP, this.TargetLRA)
+}
+
+func (this *Config) LoudnessSettingsFor(channel string) *LoudnessSettings {
+	this.RLock()
+	defer this.RUnlock()
+
+	for _, ls := range this.Loudness {
+		if matchAny(ls.channels, channel) {
+			return ls
+		}
+	}
+	return nil
+}
+
+var loudnormJSON = regexp.MustCompile(`(?s)\[Parsed_loudnorm[^\]]*\]\s*(\{.*?\})`)
+
+// loudnorm prints its numbers as strings, "-inf" included.
+type loudnormOutput struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// First pass of two-pass loudnorm: measure the recording so the second
+// pass (the actual transcode) can apply a linear correction.
+func (this *TranscodeJob) MeasureLoudness() error {
+	if this.Type != MEDIA_AUDIO {
+		return nil
+	}
+	ls := this.Conf.LoudnessSettingsFor(this.Job.Channel)
+	if ls == nil {
+		return nil
+	}
+	this.LoudnessTargets = ls
+
+	args := []string{"-hide_banner", "-nostats", "-i", this.Job.Path,
+		"-af", fmt.Sprintf("loudnorm=%v:print_format=json", ls.targets()), "-f", "null", "-"}
+	Log.Debug("Executing command ffmpeg with arguments: %+v", args)
+	out, err := this.RunFFmpeg(args)
+	if err != nil {
+		return fmt.Errorf("Loudness analysis failed: %v: %s", err, lastLine(out))
+	}
+
+	m := loudnormJSON.FindSubmatch(out)
+	if m == nil {
+		return fmt.Errorf("No loudnorm measurements in ffmpeg output")
+	}
+	lo := loudnormOutput{}
+	if err := json.Unmarshal(m[1], &lo); err != nil {
+		return fmt.Errorf("Could not parse loudnorm measurements: %v", err)
+	}
+
+	l := &Loudness{}
+	for _, f := range []struct {
+		s string
+		v *float64
+	}{
+		{lo.InputI, &l.InputI},
+		{lo.InputTP, &l.InputTP},
+		{lo.InputLRA, &l.InputLRA},
+		{lo.InputThresh, &l.InputThresh},
+		{lo.TargetOffset, &l.TargetOffset},
+	} {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f.s), 64)
+		if err != nil {
+			// Silent recordings measure as -inf, nothing useful to do
+			return fmt.Errorf("Unusable loudness measurement '%v'", f.s)
+		}
+		*f.v = v
+	}
+
+	Log.Info("Measured loudness of '%v': %.1f LUFS, %.1f dBTP, LRA %.1f", this.Job.Title, l.InputI, l.InputTP, l.InputLRA)
+	this.Loudness = l
+	return nil
+}
+
+// Second pass: apply the correction using the measured values.
+func (this *TranscodeJob) loudnessArgs(opts []string) []string {
+	if this.Loudness == nil || this.LoudnessTargets == nil {
+		return opts
+	}
+	l := this.Loudness
+	filter := fmt.Sprintf("loudnorm=%v:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true",
+		this.LoudnessTargets.targets(), l.InputI, l.InputTP, l.InputLRA, l.InputThresh, l.TargetOffset)
+	opts = addFilter(opts, "-af", filter)
+
+	// loudnorm resamples to 192kHz internally, put it back to something
+	// the encoder can cope with.
+	if optionValue(opts, "-ar") == "" {
+		rate := "48000"
+		if src, err := this.ProbeSource(); err == nil {
+			for _, st := range src.Streams {
+				if st.CodecType == "audio" && st.SampleRate != "" {
+					rate = st.SampleRate
+					break
+				}
+			}
+		}
+		opts = append(opts, "-ar", rate)
+	}
+	return opts
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"math/rand"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -19,6 +21,11 @@ var logFormat = logging.MustStringFormatter("[%{time:15:04:05.000}] %{level:.4s}
 var syslogFormat = logging.MustStringFormatter("%{level:.4s} (%{shortfunc}) - %{message}")
 
 func main() {
+	// The TVHeadend post-processor hook lives in the same binary
+	if len(os.Args) > 1 && os.Args[1] == "submit" {
+		os.Exit(RunSubmit(os.Args[2:]))
+	}
+
 	var configPath string
 	flag.StringVar(&configPath, "c", "/etc/tvhtc.conf", "Path to configuration file")
 	var debug bool
@@ -47,7 +54,7 @@ func main() {
 	rand.Seed(time.Now().Unix())
 	config := NewConfig()
 	if err := config.Load(configPath); err != nil {
-		fmt.Printf(err.Error())
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
@@ -60,51 +67,281 @@ func main() {
 	if err != nil {
 		Log.Fatal("Failed to recover jobs from database: %v", err)
 	}
+	if err := CleanScratchDir(config.ScratchDir, db); err != nil {
+		Log.Fatalf("Unable to prepare scratch directory: %v", err)
+	}
+	RemovePartialCopies(&config, db)
+	ReportOrphanedOutputs(&config, db)
 
 	if !debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	g := gin.Default()
 
-	g.POST("/job", func(c *gin.Context) {
+	g.POST("/job", config.Require(SCOPE_SUBMIT), func(c *gin.Context) {
 		job := &TVHJob{}
-		c.Bind(job)
+		if err := c.ShouldBindJSON(job); err != nil {
+			c.JSON(400, gin.H{"status": "error", "message": fmt.Sprintf("Invalid job: %v", err)})
+			return
+		}
+		if key := c.GetHeader("Idempotency-Key"); key != "" {
+			job.IdempotencyKey = key
+		}
 		Log.Info("Received new transcode job: %+v", job)
-		var err error
-		job.DBID, err = db.AddEntry(job)
+		id, existing, serr := SubmitJob(&config, db, job)
+		if serr != nil {
+			if serr.Code >= 500 {
+				Log.Error(serr.Error())
+			} else {
+				Log.Warning("Rejected job from %v: %v", c.ClientIP(), serr)
+			}
+			c.JSON(serr.Code, gin.H{"status": "error", "message": serr.Message})
+			return
+		}
+		state := QUEUE_QUEUED
+		if r, err := db.Job(id, JobStates()); err == nil && r != nil {
+			state = r.State
+		}
+		c.JSON(200, gin.H{"status": "ok", "id": id, "state": state, "duplicate": existing})
+		return
+	})
+
+	g.PATCH("/job/:id", config.Require(SCOPE_ADMIN), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"status": "error", "message": "Invalid job ID"})
+			return
+		}
+		var update struct {
+			Priority *int `json:"priority"`
+		}
+		if err := c.BindJSON(&update); err != nil || update.Priority == nil {
+			c.JSON(400, gin.H{"status": "error", "message": "Expected a priority"})
+			return
+		}
+		if !SetJobPriority(id, *update.Priority) {
+			c.JSON(404, gin.H{"status": "error", "message": "No such queued job"})
+			return
+		}
+		if err := db.SetPriority(id, *update.Priority); err != nil {
+			Log.Error(err.Error())
+			c.JSON(500, gin.H{"status": "error", "message": err.Error()})
+			return
+		}
+		Log.Info("Priority of job %v set to %v", id, *update.Priority)
+		c.JSON(200, gin.H{"status": "ok", "id": id, "priority": *update.Priority})
+		return
+	})
+
+	g.POST("/job/:id/cancel", config.Require(SCOPE_ADMIN), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"status": "error", "message": "Invalid job ID"})
+			return
+		}
+		found, running := CancelJob(id)
+		if !found {
+			c.JSON(404, gin.H{"status": "error", "message": "No such queued or running job"})
+			return
+		}
+		// A running job records its own failure when it stops
+		if !running {
+			if err := db.Cancel(id); err != nil {
+				Log.Error(err.Error())
+				c.JSON(500, gin.H{"status": "error", "message": err.Error()})
+				return
+			}
+		}
+		Log.Info("Job %v cancelled", id)
+		c.JSON(200, gin.H{"status": "ok", "id": id})
+		return
+	})
+
+	g.POST("/job/:id/retry", config.Require(SCOPE_ADMIN), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"status": "error", "message": "Invalid job ID"})
+			return
+		}
+		job, err := db.Retry(id)
 		if err != nil {
 			Log.Error(err.Error())
 			c.JSON(500, gin.H{"status": "error", "message": err.Error()})
 			return
 		}
+		if job == nil {
+			c.JSON(404, gin.H{"status": "error", "message": "No such failed job"})
+			return
+		}
+		Log.Info("Retrying job %v", id)
 		Transcode(job)
-		c.JSON(200, gin.H{"status": "ok"})
+		c.JSON(200, gin.H{"status": "ok", "id": id})
+		return
+	})
+
+	g.GET("/queue", config.Require(SCOPE_READ), func(c *gin.Context) {
+		running, progress, queued, err := db.QueueDetail()
+		if err != nil {
+			Log.Error(err.Error())
+			c.JSON(500, gin.H{"message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"running": running, "progress": progress, "queued": queued})
 		return
 	})
 
-	g.GET("/incompletejobs", func(c *gin.Context) {
+	g.GET("/notifications", config.Require(SCOPE_READ), func(c *gin.Context) {
+		c.JSON(200, gin.H{"routing": config.NotificationRouting()})
+		return
+	})
+
+	g.GET("/", func(c *gin.Context) {
+		c.Redirect(302, "/ui/")
+	})
+	g.Group("/ui", config.RequireDashboard()).StaticFS("/", DashboardFS())
+
+	g.GET("/incompletejobs", config.Require(SCOPE_READ), func(c *gin.Context) {
 		jobs, err := db.IncompleteJobs()
 		if err != nil {
 			Log.Error(err.Error())
 			c.JSON(500, gin.H{"message": err.Error()})
 			return
 		}
-		c.JSON(200, gin.H{"jobs": jobs})
+		summaries := NewJobSummaries(jobs)
+		for i := range summaries {
+			summaries[i].QueueState = JobState(summaries[i].ID)
+		}
+		c.JSON(200, gin.H{"jobs": summaries})
 		return
 	})
 
-	g.GET("/recentcompleted", func(c *gin.Context) {
+	g.GET("/recentcompleted", config.Require(SCOPE_READ), func(c *gin.Context) {
 		jobs, err := db.GetRecentCompleted()
 		if err != nil {
 			Log.Error(err.Error())
 			c.JSON(500, gin.H{"message": err.Error()})
 			return
 		}
-		c.JSON(200, gin.H{"jobs": jobs})
+		c.JSON(200, gin.H{"jobs": NewJobSummaries(jobs)})
 		return
 	})
 
-	g.GET("/memstats", func(c *gin.Context) {
+	g.GET("/jobs", config.Require(SCOPE_READ), func(c *gin.Context) {
+		q, err := ParseJobQuery(c.Request.URL.Query())
+		if err != nil {
+			c.JSON(400, gin.H{"message": err.Error()})
+			return
+		}
+		jobs, next, err := db.Jobs(q, JobStates())
+		if err != nil {
+			Log.Error(err.Error())
+			c.JSON(500, gin.H{"message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"jobs": jobs, "next_cursor": next})
+		return
+	})
+
+	g.GET("/stats", config.Require(SCOPE_READ), func(c *gin.Context) {
+		var from, to time.Time
+		var err error
+		if s := c.Query("from"); s != "" {
+			if from, err = parseQueryTime(s); err != nil {
+				c.JSON(400, gin.H{"message": err.Error()})
+				return
+			}
+		}
+		if s := c.Query("to"); s != "" {
+			if to, err = parseQueryTime(s); err != nil {
+				c.JSON(400, gin.H{"message": err.Error()})
+				return
+			}
+		}
+		stats, err := db.Stats(from, to)
+		if err != nil {
+			Log.Error(err.Error())
+			c.JSON(500, gin.H{"message": err.Error()})
+			return
+		}
+		c.JSON(200, stats)
+		return
+	})
+
+	g.GET("/job/:id", config.Require(SCOPE_READ), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "Invalid job ID"})
+			return
+		}
+		job, err := db.Job(id, JobStates())
+		if err != nil {
+			Log.Error(err.Error())
+			c.JSON(500, gin.H{"message": err.Error()})
+			return
+		}
+		if job == nil {
+			c.JSON(404, gin.H{"message": "No such job"})
+			return
+		}
+		c.JSON(200, gin.H{"job": job})
+		return
+	})
+
+	g.GET("/job/:id/commercials", config.Require(SCOPE_READ), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "Invalid job ID"})
+			return
+		}
+		segments, err := db.Commercials(id)
+		if err != nil {
+			Log.Error(err.Error())
+			c.JSON(500, gin.H{"message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"commercials": segments})
+		return
+	})
+
+	g.GET("/trash", config.Require(SCOPE_READ), func(c *gin.Context) {
+		entries, err := db.TrashedOriginals()
+		if err != nil {
+			Log.Error(err.Error())
+			c.JSON(500, gin.H{"message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"trash": entries})
+		return
+	})
+
+	g.POST("/trash/:id/restore", config.Require(SCOPE_ADMIN), func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"status": "error", "message": "Invalid trash ID"})
+			return
+		}
+		if entry, err := db.TrashEntry(id); err == nil && (entry == nil || entry.State != TRASH_TRASHED) {
+			c.JSON(404, gin.H{"status": "error", "message": "No such trashed original"})
+			return
+		}
+		entry, err := db.RestoreOriginal(id)
+		if err != nil {
+			Log.Error(err.Error())
+			c.JSON(500, gin.H{"status": "error", "message": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"status": "ok", "restored": entry})
+		return
+	})
+
+	g.GET("/metrics", config.Require(SCOPE_READ), func(c *gin.Context) {
+		buf := &bytes.Buffer{}
+		WriteMetrics(buf)
+		c.Data(200, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+		return
+	})
+
+	g.GET("/memstats", config.Require(SCOPE_READ), func(c *gin.Context) {
 		// memory stats
 		ms := runtime.MemStats{}
 		runtime.ReadMemStats(&ms)
@@ -121,6 +358,9 @@ func main() {
 			case os.Interrupt, syscall.SIGTERM:
 				Log.Warning("Caught signal, shutting down. %v jobs left in queue.", QueueLength())
 				StopQueueManager()
+				StopTrashJanitor()
+				StopSpoolWatcher()
+				StopTVHMonitor()
 				db.Close()
 				os.Exit(0)
 			case syscall.SIGUSR1:
@@ -149,6 +389,24 @@ func main() {
 		}
 	}()
 
+	StartTVHMonitor(&config)
 	StartQueueManager(&config, db)
-	g.Run(fmt.Sprintf(":%d", port))
+	StartTrashJanitor(db)
+	StartSpoolWatcher(&config, db)
+
+	addr := config.API.Address(port)
+	if len(config.Recordings.Roots) == 0 {
+		Log.Warning("No recording roots configured, jobs may be submitted for any file")
+	}
+	if config.API.Open() {
+		Log.Warning("No API tokens or dashboard login configured, anyone who can reach %v can use the API", addr)
+	}
+	if config.API.TLS.Cert != "" {
+		Log.Info("Listening on %v with TLS", addr)
+		err = g.RunTLS(addr, config.API.TLS.Cert, config.API.TLS.Key)
+	} else {
+		Log.Info("Listening on %v", addr)
+		err = g.Run(addr)
+	}
+	Log.Fatalf("Unable to start API server: %v", err)
 }
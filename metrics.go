@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job outcomes for tvhtc_jobs_total.
+const (
+	OUTCOME_SUCCESS          = "success"
+	OUTCOME_FAILED           = "failed"
+	OUTCOME_RECORDING_FAILED = "recording_failed"
+)
+
+// Transcode duration histogram buckets, in seconds.
+var durationBuckets = []float64{60, 300, 600, 1200, 1800, 3600, 7200, 14400}
+
+var startTime = time.Now()
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (this *histogram) observe(v float64) {
+	if this.counts == nil {
+		this.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, b := range durationBuckets {
+		if v <= b {
+			this.counts[i]++
+		}
+	}
+	this.count++
+	this.sum += v
+}
+
+// Counters for /metrics. Everything is since startup, Prometheus copes
+// with the resets.
+type metricSet struct {
+	sync.Mutex
+	jobs          map[[3]string]uint64
+	notifications map[[2]string]uint64
+	durations     map[string]*histogram
+	bytesIn       int64
+	bytesOut      int64
+	lastSuccess   time.Time
+}
+
+var metrics = &metricSet{
+	jobs:          make(map[[3]string]uint64),
+	notifications: make(map[[2]string]uint64),
+	durations:     make(map[string]*histogram),
+}
+
+func mediaName(t MediaType) string {
+	switch t {
+	case MEDIA_VIDEO:
+		return "video"
+	case MEDIA_AUDIO:
+		return "audio"
+	}
+	return "unknown"
+}
+
+func notifierType(n Notifier) string {
+	switch n.(type) {
+	case PushoverNotifier, *PushoverNotifier:
+		return "pushover"
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+// Count a finished job.
+func (this *metricSet) jobFinished(job *TranscodeJob) {
+	this.Lock()
+	defer this.Unlock()
+
+	outcome := OUTCOME_FAILED
+	switch {
+	case job.Job.Status != "OK":
+		outcome = OUTCOME_RECORDING_FAILED
+	case job.Success:
+		outcome = OUTCOME_SUCCESS
+	}
+	media := mediaName(job.Type)
+	this.jobs[[3]string{media, job.Job.Channel, outcome}]++
+
+	if outcome != OUTCOME_SUCCESS {
+		return
+	}
+	h, ok := this.durations[media]
+	if !ok {
+		h = &histogram{}
+		this.durations[media] = h
+	}
+	h.observe(job.ElapsedTime.Seconds())
+	this.bytesIn += job.OldSize
+	this.bytesOut += job.NewSize
+	this.lastSuccess = time.Now()
+}
+
+func (this *metricSet) notified(n Notifier, err error) {
+	this.Lock()
+	defer this.Unlock()
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	this.notifications[[2]string{notifierType(n), result}]++
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Format label pairs as {a="x",b="y"}.
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value interface{}) {
+	writeHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%v %v\n", name, value)
+}
+
+// Write everything out in the Prometheus text exposition format.
+func WriteMetrics(w io.Writer) {
+	depth, procs := QueueLength(), runningProcs.Count()
+	running := 0
+	if tcQueue.Running() {
+		running = 1
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	writeMetric(w, "tvhtc_queue_depth", "gauge", "Jobs waiting in the queue.", depth)
+	writeMetric(w, "tvhtc_running_jobs", "gauge", "Jobs currently being transcoded.", running)
+	writeMetric(w, "tvhtc_running_processes", "gauge", "ffmpeg and comskip processes currently running.", procs)
+
+	writeHeader(w, "tvhtc_jobs_total", "counter", "Finished jobs by media type, channel and outcome.")
+	jobKeys := make([][3]string, 0, len(metrics.jobs))
+	for k := range metrics.jobs {
+		jobKeys = append(jobKeys, k)
+	}
+	sort.Slice(jobKeys, func(i, j int) bool {
+		return strings.Join(jobKeys[i][:], "\x00") < strings.Join(jobKeys[j][:], "\x00")
+	})
+	for _, k := range jobKeys {
+		fmt.Fprintf(w, "tvhtc_jobs_total%v %v\n", labels("type", k[0], "channel", k[1], "outcome", k[2]), metrics.jobs[k])
+	}
+
+	writeHeader(w, "tvhtc_transcode_duration_seconds", "histogram", "Time taken by successful transcodes.")
+	media := make([]string, 0, len(metrics.durations))
+	for k := range metrics.durations {
+		media = append(media, k)
+	}
+	sort.Strings(media)
+	for _, m := range media {
+		h := metrics.durations[m]
+		for i, b := range durationBuckets {
+			fmt.Fprintf(w, "tvhtc_transcode_duration_seconds_bucket%v %v\n", labels("type", m, "le", fmt.Sprint(b)), h.counts[i])
+		}
+		fmt.Fprintf(w, "tvhtc_transcode_duration_seconds_bucket%v %v\n", labels("type", m, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "tvhtc_transcode_duration_seconds_sum%v %v\n", labels("type", m), h.sum)
+		fmt.Fprintf(w, "tvhtc_transcode_duration_seconds_count%v %v\n", labels("type", m), h.count)
+	}
+
+	writeMetric(w, "tvhtc_bytes_in_total", "counter", "Size of recordings successfully transcoded.", metrics.bytesIn)
+	writeMetric(w, "tvhtc_bytes_out_total", "counter", "Size of the outputs of successful transcodes.", metrics.bytesOut)
+
+	writeHeader(w, "tvhtc_notifications_total", "counter", "Notifications sent by notifier type and result.")
+	noteKeys := make([][2]string, 0, len(metrics.notifications))
+	for k := range metrics.notifications {
+		noteKeys = append(noteKeys, k)
+	}
+	sort.Slice(noteKeys, func(i, j int) bool {
+		return noteKeys[i][0]+"\x00"+noteKeys[i][1] < noteKeys[j][0]+"\x00"+noteKeys[j][1]
+	})
+	for _, k := range noteKeys {
+		fmt.Fprintf(w, "tvhtc_notifications_total%v %v\n", labels("notifier", k[0], "result", k[1]), metrics.notifications[k])
+	}
+
+	last := 0.0
+	if !metrics.lastSuccess.IsZero() {
+		last = float64(metrics.lastSuccess.UnixNano()) / 1e9
+	}
+	writeMetric(w, "tvhtc_last_success_timestamp_seconds", "gauge", "When the last successful transcode finished.", last)
+
+	writeRuntimeMetrics(w)
+}
+
+// The usual Go runtime metrics, named as client_golang names them.
+func writeRuntimeMetrics(w io.Writer) {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+
+	writeHeader(w, "go_info", "gauge", "Information about the Go environment.")
+	fmt.Fprintf(w, "go_info%v 1\n", labels("version", runtime.Version()))
+	writeMetric(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.", runtime.NumGoroutine())
+	writeMetric(w, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", ms.Alloc)
+	writeMetric(w, "go_memstats_alloc_bytes_total", "counter", "Total number of bytes allocated, even if freed.", ms.TotalAlloc)
+	writeMetric(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.", ms.Sys)
+	writeMetric(w, "go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.", ms.HeapAlloc)
+	writeMetric(w, "go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.", ms.HeapInuse)
+	writeMetric(w, "go_memstats_heap_objects", "gauge", "Number of allocated objects.", ms.HeapObjects)
+	writeMetric(w, "go_memstats_mallocs_total", "counter", "Total number of mallocs.", ms.Mallocs)
+	writeMetric(w, "go_memstats_frees_total", "counter", "Total number of frees.", ms.Frees)
+	writeMetric(w, "go_memstats_next_gc_bytes", "gauge", "Number of heap bytes when next garbage collection will take place.", ms.NextGC)
+	writeMetric(w, "go_memstats_last_gc_time_seconds", "gauge", "Number of seconds since 1970 of last garbage collection.",
+		float64(ms.LastGC)/1e9)
+	writeMetric(w, "go_gc_cycles_total", "counter", "Number of completed GC cycles.", ms.NumGC)
+	writeMetric(w, "process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.",
+		float64(startTime.UnixNano())/1e9)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabels(t *testing.T) {
+	tests := []struct {
+		pairs []string
+		want  string
+	}{
+		{nil, "{}"},
+		{[]string{"type", "video"}, `{type="video"}`},
+		{[]string{"type", "video", "channel", "BBC One"}, `{type="video",channel="BBC One"}`},
+		{[]string{"channel", `Say "hi"\` + "\n"}, `{channel="Say \"hi\"\\\n"}`},
+	}
+	for _, tt := range tests {
+		if got := labels(tt.pairs...); got != tt.want {
+			t.Errorf("labels(%q) = %v, want %v", tt.pairs, got, tt.want)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	saved := metrics
+	defer func() { metrics = saved }()
+	metrics = &metricSet{
+		jobs:          make(map[[3]string]uint64),
+		notifications: make(map[[2]string]uint64),
+		durations:     make(map[string]*histogram),
+	}
+
+	job := func(status string, success bool, elapsed time.Duration) *TranscodeJob {
+		return &TranscodeJob{
+			Job:         &TVHJob{Channel: "BBC One", Status: status},
+			Type:        MEDIA_VIDEO,
+			Success:     success,
+			ElapsedTime: elapsed,
+			OldSize:     1000,
+			NewSize:     400,
+		}
+	}
+	metrics.jobFinished(job("OK", true, 90*time.Second))
+	metrics.jobFinished(job("OK", true, 2*time.Hour))
+	metrics.jobFinished(job("OK", false, time.Minute))
+	metrics.jobFinished(job("Time missed", false, 0))
+	metrics.notified(&PushoverNotifier{}, nil)
+	metrics.notified(&PushoverNotifier{}, errors.New("nope"))
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	out := buf.String()
+
+	tests := []string{
+		"# TYPE tvhtc_jobs_total counter",
+		`tvhtc_jobs_total{type="video",channel="BBC One",outcome="success"} 2`,
+		`tvhtc_jobs_total{type="video",channel="BBC One",outcome="failed"} 1`,
+		`tvhtc_jobs_total{type="video",channel="BBC One",outcome="recording_failed"} 1`,
+		"# TYPE tvhtc_transcode_duration_seconds histogram",
+		`tvhtc_transcode_duration_seconds_bucket{type="video",le="60"} 0`,
+		`tvhtc_transcode_duration_seconds_bucket{type="video",le="300"} 1`,
+		`tvhtc_transcode_duration_seconds_bucket{type="video",le="7200"} 2`,
+		`tvhtc_transcode_duration_seconds_bucket{type="video",le="+Inf"} 2`,
+		`tvhtc_transcode_duration_seconds_sum{type="video"} 7290`,
+		`tvhtc_transcode_duration_seconds_count{type="video"} 2`,
+		"tvhtc_bytes_in_total 2000",
+		"tvhtc_bytes_out_total 800",
+		`tvhtc_notifications_total{notifier="pushover",result="failure"} 1`,
+		`tvhtc_notifications_total{notifier="pushover",result="success"} 1`,
+		"# TYPE tvhtc_queue_depth gauge",
+		"# TYPE go_goroutines gauge",
+	}
+	for _, want := range tests {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q", want)
+		}
+	}
+	// Every sample is a name, optional labels and a number
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if _, err := strconv.ParseFloat(line[i+1:], 64); i < 0 || err != nil {
+			t.Errorf("malformed sample line %q", line)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Used when thumbnail_offset isn't set in the config. Far enough in to get
+// past any channel idents at the start of the recording.
+const defaultThumbnailOffset = 5 * time.Minute
+
+// Kodi/Jellyfin episode NFO. Only the fields we actually know about from
+// TVHeadend are filled in, the media servers are happy with that.
+type EpisodeNFO struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Plot      string   `xml:"plot"`
+	Studio    string   `xml:"studio"`
+	Aired     string   `xml:"aired"`
+	Thumb     string   `xml:"thumb,omitempty"`
+}
+
+// Strip the extension from the output path, sidecar files share the
+// rest of the name.
+func (this *TranscodeJob) sidecarBase() string {
+	return strings.TrimSuffix(this.OutputPath, filepath.Ext(this.OutputPath))
+}
+
+// Write the .nfo sidecar (and the thumbnail, if wanted) next to the
+// final output.
+func (this *TranscodeJob) WriteNFO(ctx context.Context) error {
+	ns := this.Conf.NFO
+	if !ns.Enabled || this.Type != MEDIA_VIDEO {
+		return nil
+	}
+
+	recorded := this.RecordedAt
+	if recorded.IsZero() {
+		recorded = time.Now()
+	}
+	nfo := EpisodeNFO{
+		Title:     this.Job.Title,
+		ShowTitle: this.Job.Title,
+		Plot:      this.Job.Description,
+		Studio:    this.Job.Channel,
+		Aired:     recorded.Format("2006-01-02"),
+	}
+
+	if ns.Thumbnail {
+		thumb, err := this.ExtractThumbnail(ctx)
+		if err != nil {
+			Log.Warning("Unable to extract thumbnail for '%v': %v", this.Job.Title, err)
+		} else {
+			nfo.Thumb = filepath.Base(thumb)
+		}
+	}
+
+	out, err := xml.MarshalIndent(nfo, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := this.sidecarBase() + ".nfo"
+	Log.Debug("Writing NFO to %v", path)
+	return ioutil.WriteFile(path, append([]byte(xml.Header), out...), 0644)
+}
+
+// Grab a single frame from the output at the configured offset. Named the
+// way Kodi expects so it gets picked up even without the NFO.
+func (this *TranscodeJob) ExtractThumbnail(ctx context.Context) (string, error) {
+	offset := this.Conf.NFO.ThumbnailOffset
+	if offset <= 0 {
+		offset = defaultThumbnailOffset
+	}
+	// Don't seek past the end of short recordings
+	if this.SourceProbe != nil {
+		if d := this.SourceProbe.Duration(); d > 0 && offset.Seconds() >= d {
+			offset = time.Duration(d/2) * time.Second
+		}
+	}
+
+	path := this.sidecarBase() + "-thumb.jpg"
+	args := []string{"-ss", fmt.Sprintf("%.3f", offset.Seconds()), "-i", this.OutputPath,
+		"-frames:v", "1", "-q:v", "2", "-y", path}
+	Log.Debug("Executing command ffmpeg with arguments: %+v", args)
+	if out, err := this.RunFFmpegContext(ctx, args); err != nil {
+		return "", fmt.Errorf("%v: %s", err, out)
+	}
+	return path, nil
+}
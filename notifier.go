@@ -1,5 +1,67 @@
 package main
 
+import (
+	"sort"
+	"strings"
+)
+
 type Notifier interface {
 	Send(job *TranscodeJob) error
+	// For problems with tvhtc itself rather than a particular recording
+	Alert(subject, message string) error
+}
+
+// Send an alert to everyone on the notify list.
+func (this *Config) SendAlert(subject, message string) {
+	this.RLock()
+	handlers := make([]Notifier, 0)
+	for k, v := range this.NotifyList {
+		if v.Pushover != "" {
+			handlers = append(handlers, NewPushoverNotifier(k, this.PushoverToken, v.Pushover, 0))
+		}
+	}
+	this.RUnlock()
+
+	Log.Info("Sending alert '%v' to %v recipient(s)", subject, len(handlers))
+	for _, h := range handlers {
+		err := h.Alert(subject, message)
+		metrics.notified(h, err)
+		if err != nil {
+			Log.Warning("Unable to send alert: %v", err)
+		}
+	}
+}
+
+// Who gets notified about what, for the dashboard. Pushover keys are
+// mostly masked.
+type NotificationRoute struct {
+	Name      string   `json:"name"`
+	Pushover  string   `json:"pushover"`
+	Email     string   `json:"email"`
+	NotifyFor []string `json:"notify_for"`
+	IsDefault bool     `json:"is_default"`
+}
+
+func maskSecret(s string) string {
+	if len(s) <= 4 {
+		return strings.Repeat("*", len(s))
+	}
+	return strings.Repeat("*", len(s)-4) + s[len(s)-4:]
+}
+
+func (this *Config) NotificationRouting() []NotificationRoute {
+	this.RLock()
+	defer this.RUnlock()
+	routes := make([]NotificationRoute, 0, len(this.NotifyList))
+	for name, p := range this.NotifyList {
+		routes = append(routes, NotificationRoute{
+			Name:      name,
+			Pushover:  maskSecret(p.Pushover),
+			Email:     p.Email,
+			NotifyFor: p.NotifyFor,
+			IsDefault: p.IsDefault,
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Name < routes[j].Name })
+	return routes
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Longest we'll let a single path component get. Most filesystems cap
+// names at 255 bytes and we need room for collision suffixes.
+const maxComponentLength = 200
+
+var templateField = regexp.MustCompile(`\{(\w+)\}`)
+var unsafeChars = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]+`)
+var repeatedSpace = regexp.MustCompile(`\s+`)
+var doubledSeparators = regexp.MustCompile(`(\s+-){2,}\s+`)
+var danglingSeparators = regexp.MustCompile(`(\s+-)+\s*(\.\w+)?$`)
+
+// Make a value safe to use as (part of) a file or directory name.
+func SanitiseFilename(s string) string {
+	s = unsafeChars.ReplaceAllString(s, " ")
+	s = repeatedSpace.ReplaceAllString(s, " ")
+	s = strings.Trim(s, " .")
+	if len(s) > maxComponentLength {
+		s = strings.TrimRight(truncateUTF8(s, maxComponentLength), " .")
+	}
+	return s
+}
+
+// Expand an output path template such as
+// "{Title}/{Title} - {date} - {Description}.mkv" using the job details,
+// with each field made safe to use in a file name.
+func (this *TranscodeJob) ExpandTemplate(tmpl string) string {
+	return this.expandFields(tmpl, SanitiseFilename)
+}
+
+// Expand a template with the job details as they are, for things like
+// tags that aren't going anywhere near the filesystem.
+func (this *TranscodeJob) ExpandTagTemplate(tmpl string) string {
+	return this.expandFields(tmpl, strings.TrimSpace)
+}
+
+// Unknown fields are left alone so typos are obvious in the output.
+func (this *TranscodeJob) expandFields(tmpl string, clean func(string) string) string {
+	ext := filepath.Ext(this.Job.Filename)
+	recorded := this.RecordedAt
+	if recorded.IsZero() {
+		recorded = time.Now()
+	}
+	fields := map[string]string{
+		"Title":       this.Job.Title,
+		"Channel":     this.Job.Channel,
+		"Description": this.Job.Description,
+		"Filename":    strings.TrimSuffix(this.Job.Filename, ext),
+		"date":        recorded.Format("2006-01-02"),
+		"time":        recorded.Format("1504"),
+		"year":        recorded.Format("2006"),
+	}
+
+	return templateField.ReplaceAllStringFunc(tmpl, func(m string) string {
+		v, ok := fields[m[1:len(m)-1]]
+		if !ok {
+			return m
+		}
+		return clean(v)
+	})
+}
+
+// Work out where the finished output for this job should live. Returns an
+// empty string if there's no template configured for the media type, in
+// which case the output goes next to the original as it always has.
+func (this *TranscodeJob) TemplatedOutputPath() string {
+	var tmpl string
+	switch this.Type {
+	case MEDIA_VIDEO:
+		tmpl = this.Conf.Output.VideoTemplate
+	case MEDIA_AUDIO:
+		tmpl = this.Conf.Output.AudioTemplate
+	}
+	if this.Profile != nil && this.Profile.OutputTemplate != "" {
+		tmpl = this.Profile.OutputTemplate
+	}
+	if tmpl == "" {
+		return ""
+	}
+	return this.ExpandPath(this.Conf.Output.Root, tmpl)
+}
+
+// Cut s to at most n bytes without splitting a UTF-8 sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+var fileExtension = regexp.MustCompile(`\.[A-Za-z0-9]{1,8}$`)
+
+// Cap a whole path component at maxComponentLength, as several fields
+// that are each short enough can still add up to too much. The file's
+// extension is kept on the last component.
+func truncateComponent(p string, last bool) string {
+	if len(p) <= maxComponentLength {
+		return p
+	}
+	ext := ""
+	if last {
+		ext = fileExtension.FindString(p)
+	}
+	stem := truncateUTF8(strings.TrimSuffix(p, ext), maxComponentLength-len(ext))
+	return strings.TrimRight(stem, " .-") + ext
+}
+
+// Expand a path template and join it on to root, tidying up after any
+// fields that came out empty. Returns "" if there's nothing left.
+func (this *TranscodeJob) ExpandPath(root, tmpl string) string {
+	expanded := this.ExpandTemplate(tmpl)
+	// Templates can produce empty components if the field was blank,
+	// tidy them up so we don't end up with "//" or " - - ".
+	parts := strings.Split(expanded, "/")
+	clean := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = repeatedSpace.ReplaceAllString(p, " ")
+		p = doubledSeparators.ReplaceAllString(p, " - ")
+		p = danglingSeparators.ReplaceAllString(p, "$2")
+		p = strings.TrimLeft(strings.TrimSpace(p), "- ")
+		if p != "" && p != "." && p != ".." {
+			clean = append(clean, p)
+		}
+	}
+	if len(clean) == 0 {
+		return ""
+	}
+	for i := range clean {
+		clean[i] = truncateComponent(clean[i], i == len(clean)-1)
+	}
+	return filepath.Join(append([]string{root}, clean...)...)
+}
+
+// If something already exists at path, find the next free
+// "name (2).ext", "name (3).ext" etc.
+func AvoidCollision(path string) string {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%v (%d)%v", base, i, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			Log.Debug("Output %v already exists, using %v", path, candidate)
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSanitiseFilename(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Doctor Who", "Doctor Who"},
+		{"AC/DC: Live", "AC DC Live"},
+		{"  What?  Now  ", "What Now"},
+		{"...Trailing dots...", "Trailing dots"},
+		{"tab\there", "tab here"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := SanitiseFilename(tt.in); got != tt.want {
+			t.Errorf("SanitiseFilename(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	long := SanitiseFilename(strings.Repeat("Ä", 150))
+	if len(long) > maxComponentLength || !utf8.ValidString(long) {
+		t.Errorf("long value cut badly: %v bytes, valid UTF-8: %v", len(long), utf8.ValidString(long))
+	}
+}
+
+func TestTemplatedOutputPath(t *testing.T) {
+	recorded := time.Date(2019, 3, 2, 20, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		job   TVHJob
+		media MediaType
+		tmpl  string
+		want  string
+	}{
+		{
+			name:  "all fields",
+			job:   TVHJob{Title: "Doctor Who", Description: "Rose", Filename: "dw.ts"},
+			media: MEDIA_VIDEO,
+			tmpl:  "TV/{Title}/{Title} - {date} - {Description}.mkv",
+			want:  "/lib/TV/Doctor Who/Doctor Who - 2019-03-02 - Rose.mkv",
+		},
+		{
+			name:  "empty description",
+			job:   TVHJob{Title: "Doctor Who", Filename: "dw.ts"},
+			media: MEDIA_VIDEO,
+			tmpl:  "TV/{Title}/{Title} - {date} - {Description}.mkv",
+			want:  "/lib/TV/Doctor Who/Doctor Who - 2019-03-02.mkv",
+		},
+		{
+			name:  "empty directory",
+			job:   TVHJob{Title: "News", Filename: "news.ts"},
+			media: MEDIA_VIDEO,
+			tmpl:  "TV/{Channel}/{Title}.mkv",
+			want:  "/lib/TV/News.mkv",
+		},
+		{
+			name:  "dot dot title",
+			job:   TVHJob{Title: "..", Filename: "x.ts"},
+			media: MEDIA_VIDEO,
+			tmpl:  "{Title}/{Filename}.mkv",
+			want:  "/lib/x.mkv",
+		},
+		{
+			name:  "audio template",
+			job:   TVHJob{Title: "The Archers", Filename: "a.mka"},
+			media: MEDIA_AUDIO,
+			tmpl:  "Radio/{Title} - {year}.mp3",
+			want:  "/lib/Radio/The Archers - 2019.mp3",
+		},
+		{
+			name:  "nothing left",
+			job:   TVHJob{},
+			media: MEDIA_VIDEO,
+			tmpl:  "{Title}",
+			want:  "",
+		},
+		{
+			name:  "no template",
+			job:   TVHJob{Title: "News", Filename: "news.ts"},
+			media: MEDIA_VIDEO,
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := NewConfig()
+			conf.Output.Root = "/lib"
+			if tt.media == MEDIA_VIDEO {
+				conf.Output.VideoTemplate = tt.tmpl
+			} else {
+				conf.Output.AudioTemplate = tt.tmpl
+			}
+			job := tt.job
+			tc := &TranscodeJob{Job: &job, Conf: &conf, Type: tt.media, RecordedAt: recorded}
+			if got := tc.TemplatedOutputPath(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandPathCapsComponents(t *testing.T) {
+	long := strings.Repeat("Ä", 150)
+	job := &TVHJob{Title: long, Description: long, Filename: "x.ts"}
+	tc := &TranscodeJob{Job: job, RecordedAt: time.Date(2019, 3, 2, 20, 30, 0, 0, time.UTC)}
+
+	tests := []struct {
+		name string
+		tmpl string
+		part int
+		ext  string
+	}{
+		// Each field is under the cap, together they aren't
+		{"file name keeps its extension", "TV/{Title} - {Description}.mkv", 3, ".mkv"},
+		{"directory", "{Title} {Description}/x.mkv", 2, ""},
+	}
+	for _, tt := range tests {
+		got := strings.Split(tc.ExpandPath("/lib", tt.tmpl), "/")[tt.part]
+		if len(got) > maxComponentLength {
+			t.Errorf("%v: component is %v bytes, want at most %v", tt.name, len(got), maxComponentLength)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%v: split a UTF-8 sequence: %q", tt.name, got)
+		}
+		if tt.ext != "" && !strings.HasSuffix(got, tt.ext) {
+			t.Errorf("%v: extension lost: %q", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Used when a step doesn't set its own timeout.
+const defaultPostStepTimeout = 10 * time.Minute
+
+// We keep step output for later inspection, but not an unbounded amount.
+const maxPostStepOutput = 64 * 1024
+
+type PostStep interface {
+	Run(ctx context.Context, job *TranscodeJob) (string, error)
+}
+
+// Configuration for a single post-processing step. Which of the fields
+// matter depends on Type:
+//
+//	script    - Command and Args, job details are passed in TVHTC_* env vars
+//	copy      - Dest, a directory the output is copied into
+//	http      - URL, Method and Headers, e.g. to kick off a library scan
+//	nfo       - write the NFO (and thumbnail) from the nfo settings
+//	edl       - write the EDL if commercial detection found anything
+//	subtitles - extract subtitle sidecars if the profile asks for them
+//
+// The last three are built in. A profile that doesn't list them still gets
+// them, ahead of its own steps, whenever their settings turn them on.
+// Subtitles are read from the original so always run before the output is
+// put in place, and built in steps run to completion whatever the timeout.
+type PostStepConfig struct {
+	Name          string            `yaml:"name"`
+	Type          string            `yaml:"type"`
+	Timeout       time.Duration     `yaml:"timeout"`
+	StopOnFailure bool              `yaml:"stop_on_failure"`
+	Command       string            `yaml:"command"`
+	Args          []string          `yaml:"args"`
+	Dest          string            `yaml:"dest"`
+	URL           string            `yaml:"url"`
+	Method        string            `yaml:"method"`
+	Headers       map[string]string `yaml:"headers"`
+}
+
+type PostStepResult struct {
+	Name    string        `json:"name"`
+	Type    string        `json:"type"`
+	Success bool          `json:"success"`
+	Output  string        `json:"output"`
+	Started time.Time     `json:"started"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+var postStepTypes = map[string]func(PostStepConfig) (PostStep, error){
+	"script":       newScriptStep,
+	"copy":         newCopyStep,
+	"http":         newHTTPStep,
+	"nfo":          newBuiltinStep((*TranscodeJob).WriteNFO),
+	"edl":          newBuiltinStep((*TranscodeJob).WriteEDL),
+	STEP_SUBTITLES: newBuiltinStep((*TranscodeJob).ExtractSubtitles),
+}
+
+const STEP_SUBTITLES = "subtitles"
+
+// Built in steps in the order they're added to a profile's own.
+var builtinPostSteps = []string{STEP_SUBTITLES, "nfo", "edl"}
+
+func NewPostStep(sc PostStepConfig) (PostStep, error) {
+	f, ok := postStepTypes[sc.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown post-processing step type '%v'", sc.Type)
+	}
+	return f(sc)
+}
+
+// Whether a built in step has anything to do for this job.
+func (this *TranscodeJob) builtinWanted(stepType string) bool {
+	switch stepType {
+	case STEP_SUBTITLES:
+		return this.subtitleMode() == SUBTITLES_EXTRACT
+	case "nfo":
+		return this.Conf.NFO.Enabled && this.Type == MEDIA_VIDEO
+	case "edl":
+		return this.CommercialAction == COMMERCIAL_EDL && len(this.Commercials) > 0
+	}
+	return false
+}
+
+// The job's full pipeline, the profile's steps plus any built in ones it
+// didn't list that are turned on.
+func (this *TranscodeJob) postSteps() []PostStepConfig {
+	var configured []PostStepConfig
+	if this.Profile != nil {
+		configured = this.Profile.Post
+	}
+	listed := make(map[string]bool)
+	for _, sc := range configured {
+		listed[sc.Type] = true
+	}
+	steps := make([]PostStepConfig, 0, len(configured)+len(builtinPostSteps))
+	for _, t := range builtinPostSteps {
+		if !listed[t] && this.builtinWanted(t) {
+			steps = append(steps, PostStepConfig{Name: t, Type: t})
+		}
+	}
+	return append(steps, configured...)
+}
+
+// Steps that need the original, so run before DoRename() moves it.
+func (this *TranscodeJob) RunPreRenameSteps() error {
+	return this.runPostSteps(true)
+}
+
+// Run the post-processing steps in order once the output is in place.
+// Every step's outcome is recorded, a failure only stops the rest of the
+// pipeline if the step asks for it.
+func (this *TranscodeJob) RunPostProcessing() error {
+	return this.runPostSteps(false)
+}
+
+func (this *TranscodeJob) runPostSteps(preRename bool) error {
+	failed := make([]string, 0)
+	for _, sc := range this.postSteps() {
+		if (sc.Type == STEP_SUBTITLES) != preRename {
+			continue
+		}
+		result := this.runPostStep(sc)
+		this.recordPostStep(result)
+		if !result.Success {
+			failed = append(failed, result.Name)
+			if sc.StopOnFailure {
+				Log.Warning("Post-processing step '%v' failed, skipping remaining steps", result.Name)
+				break
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Post-processing step(s) failed: %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Record the steps that would have run after the rename as not having
+// run, so it's clear from the job why there's no NFO or library scan.
+func (this *TranscodeJob) SkipPostProcessing(reason string) {
+	for _, sc := range this.postSteps() {
+		if sc.Type == STEP_SUBTITLES {
+			continue
+		}
+		result := PostStepResult{Name: sc.Name, Type: sc.Type, Started: time.Now(), Output: "Skipped: " + reason}
+		if result.Name == "" {
+			result.Name = sc.Type
+		}
+		this.recordPostStep(result)
+	}
+}
+
+func (this *TranscodeJob) recordPostStep(result PostStepResult) {
+	this.PostResults = append(this.PostResults, result)
+	if err := this.DB.AddPostStepResult(this.Job.DBID, result); err != nil {
+		Log.Error(err.Error())
+	}
+}
+
+func (this *TranscodeJob) runPostStep(sc PostStepConfig) PostStepResult {
+	result := PostStepResult{Name: sc.Name, Type: sc.Type, Started: time.Now()}
+	if result.Name == "" {
+		result.Name = sc.Type
+	}
+
+	step, err := NewPostStep(sc)
+	if err != nil {
+		result.Output = err.Error()
+		return result
+	}
+
+	timeout := sc.Timeout
+	if timeout <= 0 {
+		timeout = defaultPostStepTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	Log.Info("Running post-processing step '%v' for '%v'", result.Name, this.Job.Title)
+	out, err := step.Run(ctx, this)
+	result.Elapsed = time.Since(result.Started)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Timed out after %v", timeout)
+	}
+	if len(out) > maxPostStepOutput {
+		out = out[len(out)-maxPostStepOutput:]
+	}
+	result.Output = out
+	if err != nil {
+		Log.Warning("Post-processing step '%v' failed: %v", result.Name, err)
+		result.Output = strings.TrimSpace(fmt.Sprintf("%v\n%v", out, err))
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// Environment handed to external commands so they know what they're
+// dealing with.
+func (this *TranscodeJob) Environment() []string {
+	mt := "unknown"
+	switch this.Type {
+	case MEDIA_VIDEO:
+		mt = "video"
+	case MEDIA_AUDIO:
+		mt = "audio"
+	}
+	return append(os.Environ(),
+		fmt.Sprintf("TVHTC_JOB_ID=%d", this.Job.DBID),
+		fmt.Sprintf("TVHTC_TITLE=%v", this.Job.Title),
+		fmt.Sprintf("TVHTC_CHANNEL=%v", this.Job.Channel),
+		fmt.Sprintf("TVHTC_DESCRIPTION=%v", this.Job.Description),
+		fmt.Sprintf("TVHTC_STATUS=%v", this.Job.Status),
+		fmt.Sprintf("TVHTC_SOURCE=%v", this.Job.Path),
+		fmt.Sprintf("TVHTC_OUTPUT=%v", this.OutputPath),
+		fmt.Sprintf("TVHTC_MEDIA_TYPE=%v", mt),
+		fmt.Sprintf("TVHTC_SUCCESS=%v", this.Success),
+	)
+}
+
+// One of our own side outputs, run as a step so it can be ordered and its
+// outcome recorded like any other.
+type builtinStep func(*TranscodeJob, context.Context) error
+
+func newBuiltinStep(f func(*TranscodeJob, context.Context) error) func(PostStepConfig) (PostStep, error) {
+	return func(PostStepConfig) (PostStep, error) {
+		return builtinStep(f), nil
+	}
+}
+
+func (this builtinStep) Run(ctx context.Context, job *TranscodeJob) (string, error) {
+	return "", this(job, ctx)
+}
+
+type scriptStep struct {
+	command string
+	args    []string
+}
+
+func newScriptStep(sc PostStepConfig) (PostStep, error) {
+	if sc.Command == "" {
+		return nil, fmt.Errorf("Script step '%v' has no command", sc.Name)
+	}
+	return scriptStep{command: sc.Command, args: sc.Args}, nil
+}
+
+func (this scriptStep) Run(ctx context.Context, job *TranscodeJob) (string, error) {
+	cmd := exec.CommandContext(ctx, this.command, this.args...)
+	cmd.Env = job.Environment()
+	cmd.Dir = filepath.Dir(job.OutputPath)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+type copyStep struct {
+	dest string
+}
+
+func newCopyStep(sc PostStepConfig) (PostStep, error) {
+	if sc.Dest == "" {
+		return nil, fmt.Errorf("Copy step '%v' has no destination", sc.Name)
+	}
+	return copyStep{dest: sc.Dest}, nil
+}
+
+func (this copyStep) Run(ctx context.Context, job *TranscodeJob) (string, error) {
+	if err := os.MkdirAll(this.dest, 0755); err != nil {
+		return "", err
+	}
+	dst := AvoidCollision(filepath.Join(this.dest, filepath.Base(job.OutputPath)))
+	if err := copyFile(ctx, job.OutputPath, dst); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Copied %v to %v", job.OutputPath, dst), nil
+}
+
+// Reader that gives up once its context is done, so long copies can
+// be timed out.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (this ctxReader) Read(p []byte) (int, error) {
+	if err := this.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return this.r.Read(p)
+}
+
+// Copy src to dst via a temporary file in the destination directory, so
+// nothing ever sees a partial copy under the real name.
+func copyFile(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".tvhtc-copy-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, ctxReader{ctx: ctx, r: in}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+type httpStep struct {
+	url     string
+	method  string
+	headers map[string]string
+}
+
+func newHTTPStep(sc PostStepConfig) (PostStep, error) {
+	if sc.URL == "" {
+		return nil, fmt.Errorf("HTTP step '%v' has no URL", sc.Name)
+	}
+	method := strings.ToUpper(sc.Method)
+	if method == "" {
+		method = "POST"
+	}
+	return httpStep{url: sc.URL, method: method, headers: sc.Headers}, nil
+}
+
+func (this httpStep) Run(ctx context.Context, job *TranscodeJob) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, this.method, this.url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range this.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxPostStepOutput))
+	out := fmt.Sprintf("HTTP %v: %s", resp.Status, body)
+	if resp.StatusCode >= 400 {
+		return out, fmt.Errorf("Got HTTP status %v", resp.StatusCode)
+	}
+	return out, nil
+}
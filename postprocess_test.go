@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostSteps(t *testing.T) {
+	script := PostStepConfig{Name: "hook", Type: "script", Command: "/bin/true"}
+	tests := []struct {
+		name       string
+		profile    *Profile
+		nfo        bool
+		media      MediaType
+		commercial string
+		want       []string
+	}{
+		{"nothing on", nil, false, MEDIA_VIDEO, "", []string{}},
+		{"nfo on, no profile", nil, true, MEDIA_VIDEO, "", []string{"nfo"}},
+		{"nfo is video only", nil, true, MEDIA_AUDIO, "", []string{}},
+		{
+			"built ins go first",
+			&Profile{Subtitles: SUBTITLES_EXTRACT, Post: []PostStepConfig{script}},
+			true, MEDIA_VIDEO, COMMERCIAL_EDL,
+			[]string{"subtitles", "nfo", "edl", "hook"},
+		},
+		{
+			"listed built ins keep their place",
+			&Profile{Post: []PostStepConfig{script, {Name: "nfo", Type: "nfo"}}},
+			true, MEDIA_VIDEO, "",
+			[]string{"hook", "nfo"},
+		},
+		{
+			"subtitles only when extracting",
+			&Profile{Subtitles: SUBTITLES_MUX},
+			false, MEDIA_VIDEO, "",
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := NewConfig()
+			conf.NFO.Enabled = tt.nfo
+			tc := &TranscodeJob{Conf: &conf, Profile: tt.profile, Type: tt.media, CommercialAction: tt.commercial}
+			if tt.commercial != "" {
+				tc.Commercials = []Segment{{Start: 10, End: 20}}
+			}
+			got := make([]string, 0)
+			for _, sc := range tc.postSteps() {
+				got = append(got, sc.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipPostProcessing(t *testing.T) {
+	db := testDatabase(t)
+	conf := NewConfig()
+	conf.NFO.Enabled = true
+	job := &TVHJob{DBID: 7}
+	tc := &TranscodeJob{
+		Job:     job,
+		Conf:    &conf,
+		DB:      db,
+		Type:    MEDIA_VIDEO,
+		Profile: &Profile{Subtitles: SUBTITLES_EXTRACT, Post: []PostStepConfig{{Name: "hook", Type: "script"}}},
+	}
+	tc.SkipPostProcessing("output not in place")
+
+	results, err := db.PostStepResults(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"nfo", "hook"}
+	if len(results) != len(want) {
+		t.Fatalf("got %v results, want %v: %+v", len(results), len(want), results)
+	}
+	for i, r := range results {
+		if r.Name != want[i] || r.Success || r.Output != "Skipped: output not in place" {
+			t.Errorf("result %v: %+v", i, r)
+		}
+	}
+}
+
+func TestBuiltinStepTimeout(t *testing.T) {
+	postStepTypes["stuck"] = newBuiltinStep(func(job *TranscodeJob, ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	t.Cleanup(func() { delete(postStepTypes, "stuck") })
+
+	tc := &TranscodeJob{Job: &TVHJob{Title: "News"}}
+	result := tc.runPostStep(PostStepConfig{Type: "stuck", Timeout: 10 * time.Millisecond})
+	if result.Success || !strings.Contains(result.Output, "Timed out") {
+		t.Errorf("got %+v, want a timeout", result)
+	}
+}
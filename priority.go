@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Sets the priority of jobs matching by channel and/or title. Higher
+// priorities are transcoded first, the default is 0. Rules are checked in
+// order and the first match wins.
+type PriorityRule struct {
+	Channels []string `yaml:"channels"`
+	Titles   []string `yaml:"titles"`
+	Priority int      `yaml:"priority"`
+	channels []*regexp.Regexp
+	titles   []*regexp.Regexp
+}
+
+func (this *PriorityRule) Prepare() error {
+	var err error
+	if this.channels, err = compilePatterns(this.Channels); err != nil {
+		return fmt.Errorf("Priority rule: %v", err)
+	}
+	if this.titles, err = compilePatterns(this.Titles); err != nil {
+		return fmt.Errorf("Priority rule: %v", err)
+	}
+	return nil
+}
+
+func (this *PriorityRule) Matches(job *TVHJob) bool {
+	if len(this.channels) > 0 && !matchAny(this.channels, job.Channel) {
+		return false
+	}
+	if len(this.titles) > 0 && !matchAny(this.titles, job.Title) {
+		return false
+	}
+	return true
+}
+
+// Settle the priority of a new job. One given in the payload, even 0,
+// beats the rules.
+func (this *Config) AssignPriority(job *TVHJob) {
+	if job.RequestedPriority != nil {
+		job.Priority = *job.RequestedPriority
+		return
+	}
+	job.Priority = this.PriorityFor(job)
+}
+
+// Priority for a new job from the rules, 0 if none match.
+func (this *Config) PriorityFor(job *TVHJob) int {
+	this.RLock()
+	defer this.RUnlock()
+
+	for _, r := range this.Priorities {
+		if r.Matches(job) {
+			return r.Priority
+		}
+	}
+	return 0
+}
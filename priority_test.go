@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPriorityFor(t *testing.T) {
+	conf := NewConfig()
+	conf.Priorities = []*PriorityRule{
+		{Titles: []string{"^Doctor Who$"}, Priority: 10},
+		{Channels: []string{"film4"}, Titles: []string{"^Bond"}, Priority: 5},
+		{Channels: []string{"film4"}, Priority: -5},
+	}
+	for _, r := range conf.Priorities {
+		if err := r.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		job  TVHJob
+		want int
+	}{
+		{"title rule", TVHJob{Channel: "BBC One", Title: "Doctor Who"}, 10},
+		{"case insensitive", TVHJob{Channel: "BBC One", Title: "doctor who"}, 10},
+		{"anchored", TVHJob{Channel: "BBC One", Title: "Doctor Who Confidential"}, 0},
+		{"channel and title both needed", TVHJob{Channel: "Film4", Title: "Bond: Skyfall"}, 5},
+		{"first match wins", TVHJob{Channel: "Film4", Title: "Alien"}, -5},
+		{"no match", TVHJob{Channel: "ITV", Title: "News"}, 0},
+	}
+	for _, tt := range tests {
+		if got := conf.PriorityFor(&tt.job); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	bad := &PriorityRule{Titles: []string{"("}}
+	if err := bad.Prepare(); err == nil {
+		t.Error("bad pattern accepted")
+	}
+}
+
+func TestAssignPriority(t *testing.T) {
+	conf := NewConfig()
+	conf.Priorities = []*PriorityRule{{Titles: []string{"^News$"}, Priority: 10}}
+	if err := conf.Priorities[0].Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		want    int
+	}{
+		{"no priority given", `{"title": "News"}`, 10},
+		{"explicit zero", `{"title": "News", "priority": 0}`, 0},
+		{"explicit", `{"title": "News", "priority": -3}`, -3},
+		{"no rule matches", `{"title": "Weather"}`, 0},
+	}
+	for _, tt := range tests {
+		job := &TVHJob{}
+		if err := json.Unmarshal([]byte(tt.payload), job); err != nil {
+			t.Fatal(err)
+		}
+		conf.AssignPriority(job)
+		if job.Priority != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, job.Priority, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+type ProbeStream struct {
+	Index      int               `json:"index"`
+	CodecType  string            `json:"codec_type"`
+	CodecName  string            `json:"codec_name"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Channels   int               `json:"channels"`
+	SampleRate string            `json:"sample_rate"`
+	Tags       map[string]string `json:"tags"`
+}
+
+type ProbeFormat struct {
+	Filename string `json:"filename"`
+	Duration string `json:"duration"`
+	Size     string `json:"size"`
+}
+
+type ProbeResult struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  ProbeFormat   `json:"format"`
+}
+
+// Run ffprobe against a file and return the stream and container
+// information it finds.
+func Probe(path string) (*ProbeResult, error) {
+	Log.Debug("Probing %v", path)
+	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed on '%v': %v", path, err)
+	}
+
+	pr := &ProbeResult{}
+	if err := json.Unmarshal(out, pr); err != nil {
+		return nil, fmt.Errorf("Could not parse ffprobe output for '%v': %v", path, err)
+	}
+	return pr, nil
+}
+
+// Duration of the container in seconds, or 0 if ffprobe couldn't tell us.
+func (this *ProbeResult) Duration() float64 {
+	d, err := strconv.ParseFloat(this.Format.Duration, 64)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// Number of streams of the given type ("video", "audio", "subtitle").
+func (this *ProbeResult) StreamCount(codecType string) int {
+	n := 0
+	for i := range this.Streams {
+		if this.Streams[i].CodecType == codecType {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// A profile groups together settings for a set of recordings, picked by
+// channel, title and media type. Profiles are checked in the order they
+// appear in the config and the first match wins, so a catch-all profile
+// with no match criteria should go last.
+type Profile struct {
+	Name           string              `yaml:"name"`
+	Channels       []string            `yaml:"channels"`
+	Titles         []string            `yaml:"titles"`
+	Media          string              `yaml:"media"`
+	OutputTemplate string              `yaml:"output_template"`
+	Subtitles      string              `yaml:"subtitles"`
+	Adaptive       *AdaptiveSettings   `yaml:"adaptive"`
+	Renditions     []RenditionSettings `yaml:"renditions"`
+	RenditionMode  string              `yaml:"rendition_mode"`
+	Post           []PostStepConfig    `yaml:"post"`
+	channels       []*regexp.Regexp
+	titles         []*regexp.Regexp
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i := range patterns {
+		r, err := regexp.Compile(fmt.Sprintf("(?i)%v", patterns[i]))
+		if err != nil {
+			return nil, fmt.Errorf("Regexp compilation failure: %v", err)
+		}
+		compiled[i] = r
+	}
+	return compiled, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for i := range patterns {
+		if patterns[i].MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compile the match patterns and check the post-processing steps make
+// sense. Called when the config is loaded.
+func (this *Profile) Prepare() error {
+	var err error
+	if this.channels, err = compilePatterns(this.Channels); err != nil {
+		return fmt.Errorf("Profile '%v': %v", this.Name, err)
+	}
+	if this.titles, err = compilePatterns(this.Titles); err != nil {
+		return fmt.Errorf("Profile '%v': %v", this.Name, err)
+	}
+	if this.Media != "" && this.Media != "video" && this.Media != "audio" {
+		return fmt.Errorf("Profile '%v': media must be 'video' or 'audio', not '%v'", this.Name, this.Media)
+	}
+	if !validSubtitleMode(this.Subtitles) {
+		return fmt.Errorf("Profile '%v': subtitles must be 'none', 'extract' or 'mux', not '%v'", this.Name, this.Subtitles)
+	}
+	if this.Adaptive != nil {
+		if err := this.Adaptive.Prepare(); err != nil {
+			return fmt.Errorf("Profile '%v': %v", this.Name, err)
+		}
+	}
+	if !validRenditionMode(this.RenditionMode) {
+		return fmt.Errorf("Profile '%v': rendition_mode must be 'single' or 'sequential', not '%v'", this.Name, this.RenditionMode)
+	}
+	for i := range this.Renditions {
+		if err := this.Renditions[i].Prepare(); err != nil {
+			return fmt.Errorf("Profile '%v': %v", this.Name, err)
+		}
+	}
+	for i := range this.Post {
+		if _, err := NewPostStep(this.Post[i]); err != nil {
+			return fmt.Errorf("Profile '%v': %v", this.Name, err)
+		}
+	}
+	return nil
+}
+
+func (this *Profile) Matches(job *TVHJob, media MediaType) bool {
+	if this.Media == "video" && media != MEDIA_VIDEO {
+		return false
+	}
+	if this.Media == "audio" && media != MEDIA_AUDIO {
+		return false
+	}
+	if len(this.channels) > 0 && !matchAny(this.channels, job.Channel) {
+		return false
+	}
+	if len(this.titles) > 0 && !matchAny(this.titles, job.Title) {
+		return false
+	}
+	return true
+}
+
+// Find the first profile that matches the job. Returns nil if nothing
+// matches, in which case the global settings are used.
+func (this *Config) ProfileFor(job *TVHJob, media MediaType) *Profile {
+	this.RLock()
+	defer this.RUnlock()
+
+	for _, p := range this.Profiles {
+		if p.Matches(job, media) {
+			Log.Debug("Using profile '%v' for '%v'", p.Name, job.Title)
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ffmpeg's stats line, e.g. "frame= 1234 ... time=00:01:02.50 bitrate=..."
+var ffmpegTime = regexp.MustCompile(`time=(\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// How far through the running job we are, for the dashboard.
+type Progress struct {
+	Step     string        `json:"step"`
+	Position float64       `json:"position"`
+	Duration float64       `json:"duration"`
+	Percent  float64       `json:"percent"`
+	Elapsed  time.Duration `json:"elapsed"`
+}
+
+// Progress and cancellation state, shared between the job and the API.
+type jobProgress struct {
+	sync.Mutex
+	step      string
+	position  float64
+	duration  float64
+	started   time.Time
+	cancelled bool
+}
+
+// Note what the job is up to. Position resets as each step has its own
+// ffmpeg run.
+func (this *TranscodeJob) setStep(step string) {
+	if this.progress == nil {
+		return
+	}
+	duration := this.ExpectedDuration()
+	p := this.progress
+	p.Lock()
+	defer p.Unlock()
+	if p.started.IsZero() {
+		p.started = time.Now()
+	}
+	p.step, p.position, p.duration = step, 0, duration
+}
+
+func (this *TranscodeJob) Progress() Progress {
+	p := this.progress
+	if p == nil {
+		return Progress{}
+	}
+	p.Lock()
+	defer p.Unlock()
+	pr := Progress{Step: p.step, Position: p.position, Duration: p.duration}
+	if p.duration > 0 {
+		pr.Percent = 100 * p.position / p.duration
+		if pr.Percent > 100 {
+			pr.Percent = 100
+		}
+	}
+	if !p.started.IsZero() {
+		pr.Elapsed = time.Since(p.started)
+	}
+	return pr
+}
+
+// Stop the job. Whatever it's running is killed and nothing else is
+// started, so the job fails at the next step.
+func (this *TranscodeJob) Cancel() {
+	if this.progress == nil {
+		return
+	}
+	this.progress.Lock()
+	this.progress.cancelled = true
+	this.progress.Unlock()
+	runningProcs.killAll()
+}
+
+func (this *TranscodeJob) Cancelled() bool {
+	if this.progress == nil {
+		return false
+	}
+	this.progress.Lock()
+	defer this.progress.Unlock()
+	return this.progress.cancelled
+}
+
+// Picks ffmpeg's position out of its stderr as it goes past.
+type progressWriter struct {
+	job *TranscodeJob
+}
+
+func (this progressWriter) Write(b []byte) (int, error) {
+	m := ffmpegTime.FindAllSubmatch(b, -1)
+	if len(m) == 0 {
+		return len(b), nil
+	}
+	last := m[len(m)-1]
+	h, _ := strconv.Atoi(string(last[1]))
+	min, _ := strconv.Atoi(string(last[2]))
+	s, _ := strconv.ParseFloat(string(last[3]), 64)
+
+	p := this.job.progress
+	p.Lock()
+	p.position = float64(h*3600+min*60) + s
+	p.Unlock()
+	return len(b), nil
+}
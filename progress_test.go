@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestProgressWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []string
+		duration float64
+		position float64
+		percent  float64
+	}{
+		{"nothing yet", []string{"Input #0, mpegts, from 'a.ts':\n"}, 100, 0, 0},
+		{
+			"stats line",
+			[]string{"frame= 1234 fps=50 q=28.0 size=   10240kB time=00:00:25.50 bitrate=3289.6kbits/s speed=2x\r"},
+			100, 25.5, 25.5,
+		},
+		{
+			"last of several in one write",
+			[]string{"time=00:00:10.00 bitrate=1\rtime=00:01:02.50 bitrate=1\r"},
+			0, 62.5, 0,
+		},
+		{
+			"later writes move it on",
+			[]string{"time=00:00:10.00 bitrate=1\r", "size=1kB time=01:00:00.00 bitrate=1\r", "[mp4 @ 0x1] some warning\n"},
+			7200, 3600, 50,
+		},
+		{"capped at 100", []string{"time=00:02:00.00 \r"}, 100, 120, 100},
+	}
+	for _, tt := range tests {
+		tc := &TranscodeJob{progress: &jobProgress{duration: tt.duration}}
+		w := progressWriter{job: tc}
+		for _, s := range tt.writes {
+			if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("%v: Write returned %v, %v", tt.name, n, err)
+			}
+		}
+		p := tc.Progress()
+		if p.Position != tt.position || p.Percent != tt.percent {
+			t.Errorf("%v: position %v (%v%%), want %v (%v%%)", tt.name, p.Position, p.Percent, tt.position, tt.percent)
+		}
+	}
+}
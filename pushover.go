@@ -52,7 +52,19 @@ func (this PushoverNotifier) Send(job *TranscodeJob) error {
 	return this.Push(msg, job.Job.Title, job.Job.Channel, job.Success)
 }
 
+func (this PushoverNotifier) Alert(subject, message string) error {
+	Log.Info("Sending Pushover alert '%v' to '%v'", subject, this.Name)
+	return this.post(fmt.Sprintf("TVHTC: %v", subject), message)
+}
+
 func (this *PushoverNotifier) Push(message, title, channel string, success bool) error {
+	if success {
+		return this.post(fmt.Sprintf("New Recording: %v (%v)", title, channel), message)
+	}
+	return this.post(fmt.Sprintf("Failed Recording: %v (%v)", title, channel), message)
+}
+
+func (this *PushoverNotifier) post(title, message string) error {
 	if len(message) > 512 {
 		message = message[:512]
 	}
@@ -63,11 +75,7 @@ func (this *PushoverNotifier) Push(message, title, channel string, success bool)
 	payload.Add("user", this.User)
 	payload.Add("priority", strconv.Itoa(this.Priority))
 	payload.Add("timestamp", strconv.Itoa(int(time.Now().Unix())))
-	if success {
-		payload.Add("title", fmt.Sprintf("New Recording: %v (%v)", title, channel))
-	} else {
-		payload.Add("title", fmt.Sprintf("Failed Recording: %v (%v)", title, channel))
-	}
+	payload.Add("title", title)
 	payload.Add("message", message)
 
 	resp, err := http.PostForm(pushoverMessageAPI, payload)
@@ -1,35 +1,375 @@
 package main
 
-var tcQueue = make(chan *TVHJob, 32)
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where a job is in the queue, as reported by the API.
+const (
+	QUEUE_QUEUED  = "queued"
+	QUEUE_WAITING = "waiting for window"
+	QUEUE_RUNNING = "running"
+	QUEUE_PAUSED  = "paused"
+	QUEUE_NOSPACE = "waiting for disk space"
+)
+
+// How often to recheck schedule windows when nothing else is happening.
+const scheduleInterval = time.Minute
+
+// Jobs waiting to be transcoded, taken highest priority first and then
+// oldest first. Jobs held back by their schedule window stay in the queue
+// without blocking the ones behind them. Failed recordings only need a
+// notification, so they're taken by their own worker and never wait
+// behind a transcode, even one paused outside its window.
+type jobQueue struct {
+	sync.Mutex
+	jobs       []*TVHJob
+	running    *TVHJob
+	current    *TranscodeJob
+	window     *ScheduleWindow
+	conf       *Config
+	wake       chan bool
+	notifyWake chan bool
+	// The running job was cancelled before its transcode started
+	cancelled bool
+}
+
+var tcQueue = &jobQueue{wake: make(chan bool, 1), notifyWake: make(chan bool, 1)}
 var shutdownManager = make(chan bool)
 
 func Transcode(job *TVHJob) {
-	tcQueue <- job
+	tcQueue.Lock()
+	tcQueue.jobs = append(tcQueue.jobs, job)
+	tcQueue.Unlock()
+	tcQueue.poke()
 	return
 }
 
+func (this *jobQueue) poke() {
+	for _, c := range []chan bool{this.wake, this.notifyWake} {
+		select {
+		case c <- true:
+		default:
+		}
+	}
+}
+
+// Jobs for failed recordings, which are just notified about.
+func notifyOnly(job *TVHJob) bool {
+	return job.Status != "OK"
+}
+
+// Whether a should be transcoded before b. IDs go up as jobs are added,
+// so they stand in for age.
+func runsBefore(a, b *TVHJob) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.DBID < b.DBID
+}
+
+// Take the best job whose window is open off the queue and mark it as
+// running. Returns nil if nothing can run right now.
+func (this *jobQueue) next() *TVHJob {
+	this.Lock()
+	defer this.Unlock()
+	now := time.Now()
+	best := -1
+	var window *ScheduleWindow
+	for i, job := range this.jobs {
+		if notifyOnly(job) {
+			continue
+		}
+		w := this.conf.WindowFor(job)
+		if w != nil && !w.Open(now) {
+			continue
+		}
+		if best < 0 || runsBefore(job, this.jobs[best]) {
+			best, window = i, w
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	job := this.jobs[best]
+	this.jobs = append(this.jobs[:best], this.jobs[best+1:]...)
+	this.running, this.window, this.cancelled = job, window, false
+	return job
+}
+
+// Take the oldest failed recording off the queue, or nil if there isn't
+// one.
+func (this *jobQueue) nextNotification() *TVHJob {
+	this.Lock()
+	defer this.Unlock()
+	for i, job := range this.jobs {
+		if notifyOnly(job) {
+			this.jobs = append(this.jobs[:i], this.jobs[i+1:]...)
+			return job
+		}
+	}
+	return nil
+}
+
+// Change the priority of a queued job. Returns false if it isn't waiting
+// in the queue, running jobs included.
+func (this *jobQueue) SetPriority(id int64, priority int) bool {
+	this.Lock()
+	defer this.Unlock()
+	for _, job := range this.jobs {
+		if job.DBID == id {
+			job.Priority = priority
+			return true
+		}
+	}
+	return false
+}
+
+func (this *jobQueue) Running() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.running != nil
+}
+
+// Put a job we took but couldn't start back in the queue. Returns false
+// if it was cancelled in the meantime, in which case it isn't.
+func (this *jobQueue) requeue(job *TVHJob) bool {
+	this.Lock()
+	defer this.Unlock()
+	cancelled := this.cancelled
+	if !cancelled {
+		this.jobs = append(this.jobs, job)
+	}
+	this.running, this.window, this.cancelled = nil, nil, false
+	return !cancelled
+}
+
+// Note the transcode of the job taken by next() is starting. Returns false
+// if it was cancelled since, in which case it shouldn't.
+func (this *jobQueue) started(tc *TranscodeJob) bool {
+	this.Lock()
+	defer this.Unlock()
+	if this.cancelled {
+		return false
+	}
+	this.current = tc
+	return true
+}
+
+func (this *jobQueue) finished() {
+	this.Lock()
+	defer this.Unlock()
+	this.running, this.current, this.window, this.cancelled = nil, nil, nil, false
+	runningProcs.setHeld(false)
+}
+
+// Pause or resume the running job if its window has closed or reopened
+// and its window says to pause.
+func (this *jobQueue) enforceWindow() {
+	this.Lock()
+	defer this.Unlock()
+	if this.running == nil || this.window == nil || this.window.AtEnd != WINDOW_PAUSE {
+		return
+	}
+	held := !this.window.Open(time.Now())
+	if held != runningProcs.isHeld() {
+		if held {
+			Log.Info("Window %v closed, pausing '%v'", this.window, this.running.Title)
+		} else {
+			Log.Info("Window %v open, resuming '%v'", this.window, this.running.Title)
+		}
+	}
+	runningProcs.setHeld(held)
+}
+
+// Queue state of a job, or "" if it isn't in the queue.
+func (this *jobQueue) State(id int64) string {
+	return this.States()[id]
+}
+
+// Queue state of every job in the queue, by ID.
+func (this *jobQueue) States() map[int64]string {
+	this.Lock()
+	defer this.Unlock()
+	states := make(map[int64]string)
+	if this.running != nil {
+		states[this.running.DBID] = QUEUE_RUNNING
+		if runningProcs.isHeld() {
+			states[this.running.DBID] = QUEUE_PAUSED
+		}
+	}
+	now := time.Now()
+	for _, job := range this.jobs {
+		switch w := this.conf.WindowFor(job); {
+		case w != nil && !w.Open(now):
+			states[job.DBID] = QUEUE_WAITING
+		case diskGuard.isHeld():
+			states[job.DBID] = QUEUE_NOSPACE
+		default:
+			states[job.DBID] = QUEUE_QUEUED
+		}
+	}
+	return states
+}
+
+// Take a job off the queue, or stop it if it's running. Returns whether
+// the job was found and whether it was the running one, which records its
+// own cancellation. One that's been taken but hasn't started yet is
+// stopped before it does.
+func (this *jobQueue) Cancel(id int64) (bool, bool) {
+	this.Lock()
+	defer this.Unlock()
+	if this.current != nil && this.current.Job.DBID == id {
+		this.current.Cancel()
+		return true, true
+	}
+	if this.running != nil && this.running.DBID == id {
+		this.cancelled = true
+		return true, true
+	}
+	for i, job := range this.jobs {
+		if job.DBID == id {
+			this.jobs = append(this.jobs[:i], this.jobs[i+1:]...)
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// The running job's ID and progress (ID 0 if nothing's running) and the
+// IDs of the queued jobs in the order they'd run, windows aside.
+func (this *jobQueue) Snapshot() (int64, Progress, []int64) {
+	this.Lock()
+	defer this.Unlock()
+	var id int64
+	var progress Progress
+	if this.current != nil {
+		id, progress = this.current.Job.DBID, this.current.Progress()
+	}
+	queued := append([]*TVHJob{}, this.jobs...)
+	sort.Slice(queued, func(i, j int) bool { return runsBefore(queued[i], queued[j]) })
+	ids := make([]int64, len(queued))
+	for i, job := range queued {
+		ids[i] = job.DBID
+	}
+	return id, progress, ids
+}
+
+func CancelJob(id int64) (bool, bool) {
+	return tcQueue.Cancel(id)
+}
+
+func QueueSnapshot() (int64, Progress, []int64) {
+	return tcQueue.Snapshot()
+}
+
+func JobState(id int64) string {
+	return tcQueue.State(id)
+}
+
+func JobStates() map[int64]string {
+	return tcQueue.States()
+}
+
+func SetJobPriority(id int64, priority int) bool {
+	return tcQueue.SetPriority(id, priority)
+}
+
 func StartQueueManager(config *Config, db *Database) {
 	Log.Warning("Queue manager starting up.")
+	tcQueue.Lock()
+	tcQueue.conf = config
+	tcQueue.Unlock()
+
+	// Keeps an eye on the window of whatever's running
+	go func() {
+		for range time.Tick(scheduleInterval) {
+			tcQueue.enforceWindow()
+		}
+	}()
+
+	go func() {
+		for {
+			job := tcQueue.nextNotification()
+			if job == nil {
+				<-tcQueue.notifyWake
+				continue
+			}
+			tc := NewTranscodeJob(job, config, db)
+			tc.Transcode()
+			finishJob(&tc, db)
+		}
+	}()
+
 	go func() {
 		for {
 			select {
-			case job := <-tcQueue:
-				Log.Info("Processing transcode job: %+v", job)
-				tc := NewTranscodeJob(job, config)
-				tc.Transcode()
-				err := db.Complete(&tc)
-				if err != nil {
-					Log.Error(err.Error())
-				}
-				Log.Info("%v jobs remaining in queue.", QueueLength())
 			case <-shutdownManager:
 				Log.Warning("Queue manager shutting down.")
 				return
+			default:
+			}
+
+			job := tcQueue.next()
+			if job == nil {
+				select {
+				case <-tcQueue.wake:
+				case <-time.After(scheduleInterval):
+				case <-shutdownManager:
+					Log.Warning("Queue manager shutting down.")
+					return
+				}
+				continue
 			}
+
+			tc := NewTranscodeJob(job, config, db)
+			if err := tc.CheckDiskSpace(); err != nil {
+				if !tcQueue.requeue(job) {
+					tc.Message = "Cancelled"
+					finishJob(&tc, db)
+					continue
+				}
+				diskGuard.hold(config, err)
+				select {
+				case <-time.After(config.DiskGuard.CheckInterval):
+				case <-shutdownManager:
+					Log.Warning("Queue manager shutting down.")
+					return
+				}
+				continue
+			}
+			diskGuard.release(config)
+
+			if !tcQueue.started(&tc) {
+				tcQueue.finished()
+				tc.Message = "Cancelled"
+				finishJob(&tc, db)
+				continue
+			}
+			Log.Info("Processing transcode job: %+v", job)
+			if err := db.Started(job.DBID); err != nil {
+				Log.Error(err.Error())
+			}
+			tc.Transcode()
+			tcQueue.finished()
+			if tc.Cancelled() && !tc.Success {
+				tc.Message = "Cancelled"
+			}
+			finishJob(&tc, db)
 		}
 	}()
 }
 
+func finishJob(tc *TranscodeJob, db *Database) {
+	metrics.jobFinished(tc)
+	if err := db.Complete(tc); err != nil {
+		Log.Error(err.Error())
+	}
+	Log.Info("%v jobs remaining in queue.", QueueLength())
+}
+
 // stop the manager goroutine after the current job has finished
 // processing.
 func StopQueueManager() {
@@ -39,5 +379,7 @@ func StopQueueManager() {
 }
 
 func QueueLength() int {
-	return len(tcQueue)
+	tcQueue.Lock()
+	defer tcQueue.Unlock()
+	return len(tcQueue.jobs)
 }
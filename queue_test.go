@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueOrder(t *testing.T) {
+	// A window that's shut for the next couple of hours whenever this runs
+	now := time.Now()
+	closed := &ScheduleWindow{Media: "audio", Start: now.Add(2 * time.Hour).Format("15:04"), End: now.Add(3 * time.Hour).Format("15:04")}
+	if err := closed.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	conf := NewConfig()
+	conf.Schedule = []*ScheduleWindow{closed}
+
+	job := func(id int64, priority int, filename, status string) *TVHJob {
+		return &TVHJob{DBID: id, Priority: priority, Filename: filename, Status: status}
+	}
+	tests := []struct {
+		name          string
+		jobs          []*TVHJob
+		transcodes    []int64
+		notifications []int64
+	}{
+		{
+			name:       "oldest first",
+			jobs:       []*TVHJob{job(3, 0, "c.ts", "OK"), job(1, 0, "a.ts", "OK"), job(2, 0, "b.ts", "OK")},
+			transcodes: []int64{1, 2, 3},
+		},
+		{
+			name:       "priority beats age",
+			jobs:       []*TVHJob{job(1, 0, "a.ts", "OK"), job(2, 5, "b.ts", "OK"), job(3, -1, "c.ts", "OK"), job(4, 5, "d.ts", "OK")},
+			transcodes: []int64{2, 4, 1, 3},
+		},
+		{
+			name:       "closed window doesn't block the rest",
+			jobs:       []*TVHJob{job(1, 10, "a.mka", "OK"), job(2, 0, "b.ts", "OK")},
+			transcodes: []int64{2},
+		},
+		{
+			name:          "failed recordings go to the notification lane",
+			jobs:          []*TVHJob{job(1, 0, "a.ts", "Time missed"), job(2, 0, "b.ts", "OK"), job(3, 0, "c.mka", "Aborted by user")},
+			transcodes:    []int64{2},
+			notifications: []int64{1, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &jobQueue{conf: &conf, jobs: tt.jobs}
+			got := make([]int64, 0)
+			for j := q.next(); j != nil; j = q.next() {
+				got = append(got, j.DBID)
+			}
+			if !sameIDs(got, tt.transcodes) {
+				t.Errorf("transcoded %v, want %v", got, tt.transcodes)
+			}
+			got = got[:0]
+			for j := q.nextNotification(); j != nil; j = q.nextNotification() {
+				got = append(got, j.DBID)
+			}
+			if !sameIDs(got, tt.notifications) {
+				t.Errorf("notified %v, want %v", got, tt.notifications)
+			}
+		})
+	}
+}
+
+func TestCancelBeforeStart(t *testing.T) {
+	conf := NewConfig()
+	tests := []struct {
+		name  string
+		start func(q *jobQueue, job *TVHJob) bool
+	}{
+		{"started", func(q *jobQueue, job *TVHJob) bool { return q.started(&TranscodeJob{Job: job}) }},
+		{"requeued for disk space", func(q *jobQueue, job *TVHJob) bool { return q.requeue(job) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &jobQueue{conf: &conf, jobs: []*TVHJob{{DBID: 1, Filename: "a.ts", Status: "OK"}}}
+			job := q.next()
+			if found, running := q.Cancel(1); !found || !running {
+				t.Fatalf("Cancel() = %v, %v between next() and starting, want true, true", found, running)
+			}
+			if tt.start(q, job) {
+				t.Error("went ahead after being cancelled")
+			}
+			if q.current != nil || len(q.jobs) != 0 {
+				t.Errorf("still around: current %v, queued %v", q.current, q.jobs)
+			}
+			q.finished()
+			if found, _ := q.Cancel(1); found {
+				t.Error("cancelled again once finished")
+			}
+		})
+	}
+}
+
+func sameIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Temporary paths in use by a job, for the database.
+func (this *TranscodeJob) tempPaths() []string {
+	paths := []string{this.TempPath}
+	for _, r := range this.Renditions {
+		paths = append(paths, r.tempPath)
+	}
+	return paths
+}
+
+// The temporary paths stored for a job, one per line.
+func splitTempPaths(temps string) []string {
+	paths := make([]string, 0)
+	for _, p := range strings.Split(temps, "\n") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Delete whatever an interrupted job had written so far, as it's about to
+// be transcoded again from scratch.
+func removeStaleOutputs(job *TVHJob, temps string) {
+	for _, path := range splitTempPaths(temps) {
+		err := os.Remove(path)
+		switch {
+		case err == nil:
+			Log.Warning("Removed partial output %v of interrupted job %v", path, job.DBID)
+		case !os.IsNotExist(err):
+			Log.Warning("Unable to remove partial output %v: %v", path, err)
+		}
+	}
+}
+
+// Whatever an interrupted job whose original has gone had written, as it
+// may be the finished output and the only copy of the recording. Returns
+// the paths that are still there.
+func keptOutputs(temps string) []string {
+	kept := make([]string, 0)
+	for _, p := range splitTempPaths(temps) {
+		if _, err := os.Lstat(p); err == nil {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// Temporary paths of unfinished or failed jobs whose original has gone.
+// Whatever is at them could be the only copy of the recording, so they're
+// left alone.
+func (this *Database) unrecoverableTempPaths() (map[string]bool, error) {
+	rows, err := this.db.Query("SELECT path, IFNULL(temppaths, '') FROM transcodes WHERE success=0")
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	keep := make(map[string]bool)
+	for rows.Next() {
+		var path, temps string
+		if err := rows.Scan(&path, &temps); err != nil {
+			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		for _, t := range splitTempPaths(temps) {
+			keep[t] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error retrieving temporary paths: %v", err)
+	}
+	return keep, nil
+}
+
+// Every temporary path any job has recorded.
+func (this *Database) recordedTempPaths() (map[string]bool, error) {
+	rows, err := this.db.Query("SELECT temppaths FROM transcodes WHERE IFNULL(temppaths, '') != ''")
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	recorded := make(map[string]bool)
+	for rows.Next() {
+		var temps string
+		if err := rows.Scan(&temps); err != nil {
+			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		for _, t := range splitTempPaths(temps) {
+			recorded[t] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error retrieving temporary paths: %v", err)
+	}
+	return recorded, nil
+}
+
+// Directories we've ever read recordings from or written outputs to.
+func (this *Database) jobDirectories() ([]string, error) {
+	rows, err := this.db.Query("SELECT IFNULL(path, ''), IFNULL(outputpath, '') FROM transcodes")
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var path, output string
+		if err := rows.Scan(&path, &output); err != nil {
+			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		for _, p := range []string{path, output} {
+			if p != "" {
+				seen[filepath.Dir(p)] = true
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error retrieving job directories: %v", err)
+	}
+
+	dirs := make([]string, 0, len(seen))
+	for d := range seen {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// Look for temporary outputs that no job accounts for, such as ones left
+// behind before temporary paths were recorded. These are only reported,
+// it's up to a human to decide what to do with them. Run after Recover(),
+// which deletes the ones it knows about and fails the jobs that kept theirs.
+func (this *Database) FindOrphanedOutputs() ([]string, error) {
+	dirs, err := this.jobDirectories()
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := this.recordedTempPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make([]string, 0)
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				Log.Warning("Unable to look for orphaned outputs in %v: %v", dir, err)
+			}
+			continue
+		}
+		for _, f := range files {
+			path := filepath.Join(dir, f.Name())
+			if !f.IsDir() && tempOutputName.MatchString(f.Name()) && !recorded[path] {
+				orphans = append(orphans, path)
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// Log and alert about any orphaned outputs.
+func ReportOrphanedOutputs(conf *Config, db *Database) {
+	orphans, err := db.FindOrphanedOutputs()
+	if err != nil {
+		Log.Warning("Unable to look for orphaned outputs: %v", err)
+		return
+	}
+	if len(orphans) == 0 {
+		return
+	}
+	for _, o := range orphans {
+		Log.Warning("Found orphaned temporary output: %v", o)
+	}
+	conf.SendAlert("Orphaned temporary files",
+		fmt.Sprintf("Found %d temporary output(s) not belonging to any job:\n%v", len(orphans), strings.Join(orphans, "\n")))
+}
+
+// Remove partial copies left by copyFile() when we died mid-copy. Only
+// called at startup, so any that exist are junk.
+func RemovePartialCopies(conf *Config, db *Database) {
+	dirs, err := db.jobDirectories()
+	if err != nil {
+		Log.Warning("Unable to look for partial copies: %v", err)
+		return
+	}
+	dirs = append(dirs, conf.ScratchDir, conf.Trash.Path)
+	for _, p := range conf.Profiles {
+		for _, step := range p.Post {
+			if step.Type == "copy" {
+				dirs = append(dirs, step.Dest)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, ".tvhtc-copy-*"))
+		if err != nil {
+			continue
+		}
+		for _, m := range matches {
+			Log.Warning("Removing partial copy %v", m)
+			if err := os.Remove(m); err != nil && !os.IsNotExist(err) {
+				Log.Warning("Unable to remove %v: %v", m, err)
+			}
+		}
+	}
+}
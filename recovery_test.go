@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A job interrupted after removing its original, with its finished output
+// left at a temporary name, and a stray temporary file nothing knows about.
+func interruptedJob(t *testing.T) (db *Database, id int64, kept, stray string) {
+	db = testDatabase(t)
+	dir := t.TempDir()
+	kept = filepath.Join(dir, strings.Repeat("a", 64)+".mkv")
+	stray = filepath.Join(dir, strings.Repeat("b", 64)+".mkv")
+	for _, f := range []string{kept, stray} {
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := db.AddEntry(&TVHJob{Path: filepath.Join(dir, "news.ts"), Filename: "news.ts", Status: "OK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTempPaths(id, []string{kept}); err != nil {
+		t.Fatal(err)
+	}
+	return db, id, kept, stray
+}
+
+func TestRecoverFailsJobsWithoutOriginal(t *testing.T) {
+	db, id, kept, _ := interruptedJob(t)
+	if err := db.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	var completed, success bool
+	var message string
+	err := db.db.QueryRow("SELECT completed, success, message FROM transcodes WHERE id=?", id).Scan(&completed, &success, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !completed || success || !strings.Contains(message, kept) {
+		t.Errorf("completed %v, success %v, message %q, want a failure naming %v", completed, success, message, kept)
+	}
+
+	keep, err := db.unrecoverableTempPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keep[kept] {
+		t.Errorf("%v isn't protected from scratch cleanup", kept)
+	}
+}
+
+func TestFindOrphanedOutputs(t *testing.T) {
+	db, _, _, stray := interruptedJob(t)
+	orphans, err := db.FindOrphanedOutputs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{stray}; !reflect.DeepEqual(orphans, want) {
+		t.Errorf("got %v, want %v", orphans, want)
+	}
+}
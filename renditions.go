@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	RENDITIONS_SINGLE     = "single"
+	RENDITIONS_SEQUENTIAL = "sequential"
+)
+
+// An extra output made from the same recording, alongside the main one.
+// Settings are ffmpeg output options like transcode_settings, Template is
+// an output path template relative to the output root (or the directory
+// of the recording if there's no root).
+type RenditionSettings struct {
+	Name     string `yaml:"name"`
+	Settings string `yaml:"settings"`
+	Template string `yaml:"template"`
+}
+
+type Rendition struct {
+	Name       string        `json:"name"`
+	OutputPath string        `json:"output_path"`
+	Size       int64         `json:"size"`
+	Success    bool          `json:"success"`
+	Message    string        `json:"message"`
+	Elapsed    time.Duration `json:"elapsed"`
+	settings   string
+	tempPath   string
+}
+
+func (this *RenditionSettings) Prepare() error {
+	if this.Settings == "" {
+		return fmt.Errorf("Rendition '%v' has no settings", this.Name)
+	}
+	if this.Template == "" {
+		return fmt.Errorf("Rendition '%v' has no template", this.Name)
+	}
+	return nil
+}
+
+func validRenditionMode(mode string) bool {
+	switch mode {
+	case "", RENDITIONS_SINGLE, RENDITIONS_SEQUENTIAL:
+		return true
+	}
+	return false
+}
+
+// Single mode runs every rendition in the same ffmpeg invocation as the
+// main output so the source is only decoded once.
+func (this *TranscodeJob) renditionsInline() bool {
+	return this.Profile != nil && this.Profile.RenditionMode != RENDITIONS_SEQUENTIAL
+}
+
+// Work out where each of the profile's renditions will go.
+func (this *TranscodeJob) PrepareRenditions() error {
+	if this.Profile == nil || len(this.Profile.Renditions) == 0 {
+		return nil
+	}
+
+	root := this.Conf.Output.Root
+	if root == "" {
+		root = filepath.Dir(this.Job.Path)
+	}
+	for i, rs := range this.Profile.Renditions {
+		name := rs.Name
+		if name == "" {
+			name = fmt.Sprintf("rendition%d", i+1)
+		}
+		out := this.ExpandPath(root, rs.Template)
+		if out == "" {
+			return fmt.Errorf("Template for rendition '%v' expanded to nothing", name)
+		}
+		out = AvoidCollision(out)
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return fmt.Errorf("Unable to create directory for rendition '%v': %v", name, err)
+		}
+		r := &Rendition{
+			Name:       name,
+			OutputPath: out,
+			settings:   rs.Settings,
+			tempPath:   this.scratchPath(filepath.Dir(out), this.randomString()+filepath.Ext(out)),
+		}
+		Log.Debug("Rendition '%v' output path: %v, temporary path: %v", r.Name, r.OutputPath, r.tempPath)
+		this.Renditions = append(this.Renditions, r)
+	}
+	return nil
+}
+
+// Output options for a rendition. They get the same loudness correction,
+// advert handling and tags as the main output, but not the adaptive
+// encode, which was worked out for the main settings.
+func (this *TranscodeJob) renditionOpts(r *Rendition) []string {
+	opts := strings.Split(r.settings, " ")
+	opts = this.threadArgs(opts)
+	opts = this.loudnessArgs(opts)
+	opts = this.commercialOutputOpts(opts)
+	if this.Conf.Tags.Enabled && this.Type == MEDIA_AUDIO && strings.ToLower(filepath.Ext(r.tempPath)) == ".mp3" {
+		opts = append(opts, this.tagMetadata()...)
+	}
+	return opts
+}
+
+// Extra outputs to tack on to the main ffmpeg command in single mode.
+func (this *TranscodeJob) renditionArgs() []string {
+	if !this.renditionsInline() {
+		return nil
+	}
+	args := make([]string, 0)
+	for _, r := range this.Renditions {
+		args = append(args, this.renditionOpts(r)...)
+		args = append(args, "-y", r.tempPath)
+	}
+	return args
+}
+
+// Encode each rendition on its own, for sequential mode. Has to run
+// before the original is removed.
+func (this *TranscodeJob) RunRenditions() {
+	if len(this.Renditions) == 0 || this.renditionsInline() {
+		return
+	}
+	for _, r := range this.Renditions {
+		args := []string{"-i", this.Job.Path}
+		if this.chapterInput > 0 {
+			args = append(args, "-f", "ffmetadata", "-i", this.chapterFile)
+		}
+		args = append(args, this.renditionOpts(r)...)
+		args = append(args, "-y", r.tempPath)
+
+		Log.Info("Encoding rendition '%v' of '%v'", r.Name, this.Job.Title)
+		Log.Debug("Executing command ffmpeg with arguments: %+v", args)
+		before := time.Now()
+		out, err := this.RunFFmpeg(args)
+		r.Elapsed = time.Since(before)
+		if err != nil {
+			r.Message = fmt.Sprintf("Encode failed: %v: %s", err, lastLine(out))
+		}
+	}
+}
+
+// Check each rendition came out right and move it into place. A bad
+// rendition is removed and reported but doesn't fail the job.
+func (this *TranscodeJob) FinishRenditions() {
+	for _, r := range this.Renditions {
+		if this.renditionsInline() {
+			r.Elapsed = this.ElapsedTime
+		}
+		if r.Message == "" {
+			this.finishRendition(r)
+		}
+		if !r.Success {
+			Log.Warning("Rendition '%v' of '%v' failed: %v", r.Name, this.Job.Title, r.Message)
+			this.discardRendition(r)
+		}
+		if err := this.DB.AddRendition(this.Job.DBID, r); err != nil {
+			Log.Error(err.Error())
+		}
+	}
+}
+
+func (this *TranscodeJob) finishRendition(r *Rendition) {
+	if this.Conf.Verify.Enabled {
+		if err := this.VerifyMedia(r.tempPath); err != nil {
+			r.Message = fmt.Sprintf("Verification failed: %v", err)
+			return
+		}
+	}
+	if err := moveFile(r.tempPath, r.OutputPath); err != nil {
+		r.Message = fmt.Sprintf("Unable to move into place: %v", err)
+		return
+	}
+	r.Success = true
+	if st, err := os.Stat(r.OutputPath); err == nil {
+		r.Size = st.Size()
+	}
+	r.Message = fmt.Sprintf("%v (%v)", strings.Replace(r.OutputPath, this.Conf.TrimPath, "", -1), humanize.IBytes(uint64(r.Size)))
+}
+
+// Mark every rendition as failed, for when the main encode didn't work
+// out and we aren't going any further.
+func (this *TranscodeJob) FailRenditions(reason string) {
+	for _, r := range this.Renditions {
+		if r.Message == "" {
+			r.Message = reason
+		}
+		this.discardRendition(r)
+		if err := this.DB.AddRendition(this.Job.DBID, r); err != nil {
+			Log.Error(err.Error())
+		}
+	}
+}
+
+// Remove a rendition's partial output.
+func (this *TranscodeJob) discardRendition(r *Rendition) {
+	if err := os.Remove(r.tempPath); err != nil && !os.IsNotExist(err) {
+		Log.Warning("Unable to remove failed rendition '%v': %v", r.tempPath, err)
+	}
+}
+
+// One line per rendition for the notification message.
+func (this *TranscodeJob) RenditionSummary() string {
+	lines := make([]string, 0, len(this.Renditions))
+	for _, r := range this.Renditions {
+		state := "OK"
+		if !r.Success {
+			state = "FAILED"
+		}
+		lines = append(lines, fmt.Sprintf("%v: %v - %v", r.Name, state, r.Message))
+	}
+	return strings.Join(lines, "\n")
+}
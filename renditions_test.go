@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenditionSettingsPrepare(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings RenditionSettings
+		wantErr  bool
+	}{
+		{"complete", RenditionSettings{Name: "mobile", Settings: "-c:v libx264", Template: "{Title}.mp4"}, false},
+		{"no settings", RenditionSettings{Name: "mobile", Template: "{Title}.mp4"}, true},
+		{"no template", RenditionSettings{Name: "mobile", Settings: "-c:v libx264"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.settings.Prepare(); (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	for mode, want := range map[string]bool{"": true, "single": true, "sequential": true, "parallel": false} {
+		if got := validRenditionMode(mode); got != want {
+			t.Errorf("validRenditionMode(%q) = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestPrepareRenditions(t *testing.T) {
+	root := t.TempDir()
+	// Already there, so the second rendition has to go somewhere else
+	if err := os.MkdirAll(filepath.Join(root, "Mobile"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "Mobile", "Film.mp4"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		mode       string
+		renditions []RenditionSettings
+		want       map[string]string
+		inline     bool
+	}{
+		{
+			name: "single",
+			mode: RENDITIONS_SINGLE,
+			renditions: []RenditionSettings{
+				{Name: "audio", Settings: "-vn -c:a aac", Template: "Audio/{Title}.m4a"},
+				{Settings: "-c:v libx264", Template: "Mobile/{Title}.mp4"},
+			},
+			want: map[string]string{
+				"audio":      filepath.Join(root, "Audio", "Film.m4a"),
+				"rendition2": filepath.Join(root, "Mobile", "Film (2).mp4"),
+			},
+			inline: true,
+		},
+		{
+			name:       "sequential",
+			mode:       RENDITIONS_SEQUENTIAL,
+			renditions: []RenditionSettings{{Name: "audio", Settings: "-vn -c:a aac", Template: "Audio/{Title}.m4a"}},
+			want:       map[string]string{"audio": filepath.Join(root, "Audio", "Film.m4a")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := NewConfig()
+			conf.Output.Root = root
+			tc := &TranscodeJob{
+				Job:     &TVHJob{Title: "Film", Path: "/r/film.ts", Filename: "film.ts"},
+				Conf:    &conf,
+				Profile: &Profile{RenditionMode: tt.mode, Renditions: tt.renditions},
+			}
+			if err := tc.PrepareRenditions(); err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.Renditions) != len(tt.want) {
+				t.Fatalf("got %v renditions, want %v", len(tc.Renditions), len(tt.want))
+			}
+			for _, r := range tc.Renditions {
+				if r.OutputPath != tt.want[r.Name] {
+					t.Errorf("%v: output %v, want %v", r.Name, r.OutputPath, tt.want[r.Name])
+				}
+				if filepath.Dir(r.tempPath) != filepath.Dir(r.OutputPath) || filepath.Ext(r.tempPath) != filepath.Ext(r.OutputPath) {
+					t.Errorf("%v: temporary path %v doesn't match %v", r.Name, r.tempPath, r.OutputPath)
+				}
+			}
+
+			args := strings.Join(tc.renditionArgs(), " ")
+			if tt.inline {
+				for _, r := range tc.Renditions {
+					if !strings.Contains(args, r.settings+" -y "+r.tempPath) {
+						t.Errorf("%v missing from inline arguments %v", r.Name, args)
+					}
+				}
+			} else if args != "" {
+				t.Errorf("sequential renditions added to the main command: %v", args)
+			}
+		})
+	}
+}
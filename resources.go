@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	TVH_BUSY_PAUSE = "pause"
+	TVH_BUSY_LOWER = "lower"
+)
+
+// Used when poll_interval isn't set in the config.
+const defaultTVHPollInterval = 30 * time.Second
+
+// Niceness we drop running encodes to while TVHeadend is busy in "lower" mode.
+const busyNiceness = 19
+
+// Limits applied to the ffmpeg (and comskip) processes we start, so they
+// don't get in the way of live TV. Nice and IONice are passed to nice(1)
+// and ionice(1), CPUs to taskset(1) as a CPU list such as "2-3".
+type ResourceSettings struct {
+	Nice        int               `yaml:"nice"`
+	IONiceClass string            `yaml:"ionice_class"`
+	IONiceLevel int               `yaml:"ionice_level"`
+	CPUs        string            `yaml:"cpus"`
+	Threads     int               `yaml:"threads"`
+	Cgroup      CgroupSettings    `yaml:"cgroup"`
+	TVHeadend   TVHeadendSettings `yaml:"tvheadend"`
+}
+
+// cgroup v2 limits. Parent must be a cgroup delegated to the user we run
+// as, each process gets its own child group under it. It can't be the
+// cgroup we're running in ourselves as cgroup v2 won't hand out
+// controllers to children of a group with processes in it, so use a
+// subgroup of the service's. CPUMax is written to cpu.max as-is, e.g.
+// "200000 100000" for two CPUs' worth.
+type CgroupSettings struct {
+	Parent    string `yaml:"parent"`
+	CPUMax    string `yaml:"cpu_max"`
+	MemoryMax string `yaml:"memory_max"`
+}
+
+// Where to ask TVHeadend whether it's recording or streaming, and what to
+// do to running encodes while it is.
+type TVHeadendSettings struct {
+	URL          string        `yaml:"url"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	BusyAction   string        `yaml:"busy_action"`
+}
+
+func (this *ResourceSettings) Prepare() error {
+	switch this.IONiceClass {
+	case "", "idle", "best-effort", "realtime":
+	default:
+		return fmt.Errorf("Unknown ionice class '%v'", this.IONiceClass)
+	}
+	switch this.TVHeadend.BusyAction {
+	case "":
+		this.TVHeadend.BusyAction = TVH_BUSY_PAUSE
+	case TVH_BUSY_PAUSE, TVH_BUSY_LOWER:
+	default:
+		return fmt.Errorf("Unknown TVHeadend busy action '%v'", this.TVHeadend.BusyAction)
+	}
+	return this.Cgroup.Prepare()
+}
+
+// W_OK for access(2), which the syscall package doesn't export.
+const accessWriteOK = 0x2
+
+// Create the parent cgroup and make sure we can actually use it, rather
+// than finding out one warning per job later.
+func (this *CgroupSettings) Prepare() error {
+	if this.Parent == "" {
+		return nil
+	}
+	if err := os.MkdirAll(this.Parent, 0755); err != nil {
+		return fmt.Errorf("Unable to create cgroup parent %v: %v", this.Parent, err)
+	}
+	if err := syscall.Access(this.Parent, accessWriteOK); err != nil {
+		return fmt.Errorf("Cgroup parent %v isn't writable, is it delegated to us? %v", this.Parent, err)
+	}
+	var controllers []string
+	if this.CPUMax != "" {
+		controllers = append(controllers, "+cpu")
+	}
+	if this.MemoryMax != "" {
+		controllers = append(controllers, "+memory")
+	}
+	if len(controllers) == 0 {
+		return nil
+	}
+	// The limits only show up in the per-job groups if the controllers are
+	// enabled on the way down from the delegated group
+	enable := []byte(strings.Join(controllers, " "))
+	for _, dir := range []string{filepath.Dir(this.Parent), this.Parent} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), enable, 0644); err != nil {
+			Log.Warning("Unable to enable %v in cgroup %v: %v", string(enable), dir, err)
+		}
+	}
+	return nil
+}
+
+// Wrap a command in nice/ionice/taskset as configured. They all exec the
+// next command, so the process we end up with is the real one.
+func (this *ResourceSettings) wrap(name string, args []string) (string, []string) {
+	cmd := append([]string{name}, args...)
+	if this.CPUs != "" {
+		cmd = append([]string{"taskset", "-c", this.CPUs}, cmd...)
+	}
+	if this.IONiceClass != "" {
+		io := []string{"ionice", "-c", this.IONiceClass}
+		if this.IONiceClass != "idle" {
+			io = append(io, "-n", strconv.Itoa(this.IONiceLevel))
+		}
+		cmd = append(io, cmd...)
+	}
+	if this.Nice != 0 {
+		cmd = append([]string{"nice", "-n", strconv.Itoa(this.Nice)}, cmd...)
+	}
+	return cmd[0], cmd[1:]
+}
+
+// Add -threads to a set of ffmpeg output options if it's configured.
+func (this *TranscodeJob) threadArgs(opts []string) []string {
+	if this.Conf.Resources.Threads <= 0 {
+		return opts
+	}
+	return setOption(opts, "-threads", strconv.Itoa(this.Conf.Resources.Threads))
+}
+
+func (this *TranscodeJob) RunFFmpeg(args []string) ([]byte, error) {
+	return this.RunLimited("ffmpeg", args)
+}
+
+// As RunFFmpeg, killing ffmpeg if ctx is done first.
+func (this *TranscodeJob) RunFFmpegContext(ctx context.Context, args []string) ([]byte, error) {
+	return this.RunLimitedContext(ctx, "ffmpeg", args)
+}
+
+// Run a command under the configured resource limits and return its
+// combined output. While it runs it's tracked so the TVHeadend monitor
+// can pause it or turn it down.
+func (this *TranscodeJob) RunLimited(name string, args []string) ([]byte, error) {
+	return this.RunLimitedContext(context.Background(), name, args)
+}
+
+// As RunLimited, killing the command if ctx is done first.
+func (this *TranscodeJob) RunLimitedContext(ctx context.Context, name string, args []string) ([]byte, error) {
+	rs := &this.Conf.Resources
+	name, args = rs.wrap(name, args)
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Both streams get the same writer so os/exec copies them in one
+	// goroutine, the buffer isn't safe to share between two
+	var out bytes.Buffer
+	var w io.Writer = &out
+	if this.progress != nil {
+		w = io.MultiWriter(&out, progressWriter{job: this})
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	if this.Cancelled() {
+		return nil, fmt.Errorf("Cancelled")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	cg := rs.Cgroup.join(cmd.Process.Pid)
+	runningProcs.add(cmd.Process)
+	if this.Cancelled() {
+		// Cancelled while we were starting up
+		runningProcs.killAll()
+	}
+	err := cmd.Wait()
+	runningProcs.remove(cmd.Process)
+	rs.Cgroup.leave(cg)
+	return out.Bytes(), err
+}
+
+// Put a process in its own cgroup with the configured limits. Problems
+// are logged rather than failing the job, the limits are a nicety.
+func (this *CgroupSettings) join(pid int) string {
+	if this.Parent == "" {
+		return ""
+	}
+	dir := filepath.Join(this.Parent, fmt.Sprintf("tvhtc-%d", pid))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		Log.Warning("Unable to create cgroup %v: %v", dir, err)
+		return ""
+	}
+	limits := []struct{ file, value string }{
+		{"cpu.max", this.CPUMax},
+		{"memory.max", this.MemoryMax},
+	}
+	for _, l := range limits {
+		if l.value == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, l.file), []byte(l.value), 0644); err != nil {
+			Log.Warning("Unable to set %v in cgroup %v: %v", l.file, dir, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		Log.Warning("Unable to move process %d into cgroup %v: %v", pid, dir, err)
+	}
+	return dir
+}
+
+func (this *CgroupSettings) leave(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.Remove(dir); err != nil {
+		Log.Warning("Unable to remove cgroup %v: %v", dir, err)
+	}
+}
+
+// Processes we've started that the TVHeadend monitor and the scheduler
+// can act on. Busy is set while TVHeadend is recording or streaming, held
+// while the running job is outside its schedule window.
+type procSet struct {
+	sync.Mutex
+	procs map[*os.Process]*procState
+	busy  bool
+	held  bool
+	conf  *Config
+}
+
+// What we've currently done to a process.
+type procState struct {
+	stopped bool
+	lowered bool
+}
+
+var runningProcs = &procSet{procs: make(map[*os.Process]*procState)}
+
+func (this *procSet) add(p *os.Process) {
+	this.Lock()
+	defer this.Unlock()
+	st := &procState{}
+	this.procs[p] = st
+	this.apply(p, st)
+}
+
+func (this *procSet) remove(p *os.Process) {
+	this.Lock()
+	defer this.Unlock()
+	delete(this.procs, p)
+}
+
+// Running jobs, for reporting.
+func (this *procSet) Count() int {
+	this.Lock()
+	defer this.Unlock()
+	return len(this.procs)
+}
+
+// Kill everything, for cancelling the running job.
+func (this *procSet) killAll() {
+	this.Lock()
+	defer this.Unlock()
+	for p := range this.procs {
+		if err := p.Kill(); err != nil {
+			Log.Warning("Unable to kill process %d: %v", p.Pid, err)
+		}
+	}
+}
+
+func (this *procSet) isBusy() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.busy
+}
+
+func (this *procSet) isHeld() bool {
+	this.Lock()
+	defer this.Unlock()
+	return this.held
+}
+
+func (this *procSet) setBusy(busy bool) {
+	this.Lock()
+	defer this.Unlock()
+	this.busy = busy
+	this.applyAll()
+}
+
+func (this *procSet) setHeld(held bool) {
+	this.Lock()
+	defer this.Unlock()
+	this.held = held
+	this.applyAll()
+}
+
+func (this *procSet) applyAll() {
+	for p, st := range this.procs {
+		this.apply(p, st)
+	}
+}
+
+// Bring a process in line with the busy and held flags.
+func (this *procSet) apply(p *os.Process, st *procState) {
+	action := TVH_BUSY_PAUSE
+	if this.conf != nil {
+		action = this.conf.Resources.TVHeadend.BusyAction
+	}
+	lower := this.busy && action == TVH_BUSY_LOWER
+	stop := this.held || (this.busy && action == TVH_BUSY_PAUSE)
+
+	if lower != st.lowered {
+		nice := busyNiceness
+		if !lower {
+			// Can't raise priority back up without privileges, but we
+			// can at least try to go back to where we were.
+			nice = this.conf.Resources.Nice
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, p.Pid, nice); err != nil {
+			Log.Warning("Unable to set priority of process %d: %v", p.Pid, err)
+		}
+		st.lowered = lower
+	}
+	if stop != st.stopped {
+		sig := syscall.SIGSTOP
+		if !stop {
+			sig = syscall.SIGCONT
+		}
+		if err := p.Signal(sig); err != nil {
+			Log.Warning("Unable to send %v to process %d: %v", sig, p.Pid, err)
+		}
+		st.stopped = stop
+	}
+}
+
+// The bit of /api/status/subscriptions we care about.
+type tvhSubscriptions struct {
+	TotalCount int `json:"totalCount"`
+}
+
+// Ask TVHeadend whether anything is subscribed, which covers both
+// recordings and live streams.
+func (this *TVHeadendSettings) Busy() (bool, error) {
+	req, err := http.NewRequest("GET", this.URL+"/api/status/subscriptions", nil)
+	if err != nil {
+		return false, err
+	}
+	if this.Username != "" {
+		req.SetBasicAuth(this.Username, this.Password)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("Got HTTP status %v from TVHeadend", resp.StatusCode)
+	}
+
+	subs := tvhSubscriptions{}
+	if err := json.NewDecoder(resp.Body).Decode(&subs); err != nil {
+		return false, fmt.Errorf("Could not parse TVHeadend subscriptions: %v", err)
+	}
+	return subs.TotalCount > 0, nil
+}
+
+var shutdownMonitor = make(chan bool)
+
+// Poll TVHeadend and pause (or turn down) running encodes while it's
+// recording or streaming. Does nothing if no TVHeadend URL is configured.
+func StartTVHMonitor(config *Config) {
+	runningProcs.conf = config
+	if config.Resources.TVHeadend.URL == "" {
+		return
+	}
+	Log.Warning("TVHeadend monitor starting up.")
+	go func() {
+		interval := config.Resources.TVHeadend.PollInterval
+		if interval <= 0 {
+			interval = defaultTVHPollInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			busy, err := config.Resources.TVHeadend.Busy()
+			if err != nil {
+				Log.Warning("Unable to check TVHeadend status: %v", err)
+			} else {
+				if busy != runningProcs.isBusy() {
+					Log.Info("TVHeadend busy: %v, %v running encode(s)", busy, runningProcs.Count())
+				}
+				runningProcs.setBusy(busy)
+			}
+			select {
+			case <-ticker.C:
+			case <-shutdownMonitor:
+				Log.Warning("TVHeadend monitor shutting down.")
+				runningProcs.setBusy(false)
+				return
+			}
+		}
+	}()
+}
+
+func StopTVHMonitor() {
+	go func() {
+		shutdownMonitor <- true
+	}()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// What to do with a job still running when its window closes.
+const (
+	WINDOW_FINISH = "finish"
+	WINDOW_PAUSE  = "pause"
+)
+
+// A time of day when jobs are allowed to run, e.g. 01:00 to 07:00. Windows
+// can run past midnight. Media ("video" or "audio") and Profile pick which
+// jobs the window applies to; the first matching window is used and jobs
+// with no matching window run whenever.
+type ScheduleWindow struct {
+	Media   string `yaml:"media"`
+	Profile string `yaml:"profile"`
+	Start   string `yaml:"start"`
+	End     string `yaml:"end"`
+	AtEnd   string `yaml:"at_end"`
+	start   int
+	end     int
+}
+
+// Parse "HH:MM" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day '%v', expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (this *ScheduleWindow) Prepare() error {
+	var err error
+	if this.Media != "" && this.Media != "video" && this.Media != "audio" {
+		return fmt.Errorf("Schedule window media must be 'video' or 'audio', not '%v'", this.Media)
+	}
+	if this.start, err = parseClock(this.Start); err != nil {
+		return err
+	}
+	if this.end, err = parseClock(this.End); err != nil {
+		return err
+	}
+	switch this.AtEnd {
+	case "":
+		this.AtEnd = WINDOW_FINISH
+	case WINDOW_FINISH, WINDOW_PAUSE:
+	default:
+		return fmt.Errorf("Schedule window at_end must be 'finish' or 'pause', not '%v'", this.AtEnd)
+	}
+	return nil
+}
+
+func (this *ScheduleWindow) Matches(media MediaType, profile *Profile) bool {
+	if this.Media == "video" && media != MEDIA_VIDEO {
+		return false
+	}
+	if this.Media == "audio" && media != MEDIA_AUDIO {
+		return false
+	}
+	if this.Profile != "" && (profile == nil || profile.Name != this.Profile) {
+		return false
+	}
+	return true
+}
+
+// Whether the window is open at the given time. Equal start and end means
+// always open.
+func (this *ScheduleWindow) Open(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	switch {
+	case this.start == this.end:
+		return true
+	case this.start < this.end:
+		return m >= this.start && m < this.end
+	default:
+		return m >= this.start || m < this.end
+	}
+}
+
+func (this *ScheduleWindow) String() string {
+	return fmt.Sprintf("%v-%v", this.Start, this.End)
+}
+
+// Find the window a job has to run in, or nil if it can run at any time.
+// Failed recordings only send a notification so they're never held back.
+func (this *Config) WindowFor(job *TVHJob) *ScheduleWindow {
+	if job.Status != "OK" {
+		return nil
+	}
+	tc := TranscodeJob{Job: job}
+	if err := tc.DetermineType(); err != nil {
+		return nil
+	}
+	profile := this.ProfileFor(job, tc.Type)
+
+	this.RLock()
+	defer this.RUnlock()
+	for _, w := range this.Schedule {
+		if w.Matches(tc.Type, profile) {
+			return w
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindowPrepare(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  ScheduleWindow
+		atEnd   string
+		wantErr bool
+	}{
+		{"defaults to finish", ScheduleWindow{Start: "01:00", End: "07:00"}, WINDOW_FINISH, false},
+		{"pause", ScheduleWindow{Start: "23:30", End: "06:00", AtEnd: WINDOW_PAUSE}, WINDOW_PAUSE, false},
+		{"bad start", ScheduleWindow{Start: "1am", End: "07:00"}, "", true},
+		{"bad end", ScheduleWindow{Start: "01:00", End: "25:00"}, "", true},
+		{"bad media", ScheduleWindow{Media: "radio", Start: "01:00", End: "07:00"}, "", true},
+		{"bad at_end", ScheduleWindow{Start: "01:00", End: "07:00", AtEnd: "stop"}, "", true},
+	}
+	for _, tt := range tests {
+		err := tt.window.Prepare()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && tt.window.AtEnd != tt.atEnd {
+			t.Errorf("%v: at_end %v, want %v", tt.name, tt.window.AtEnd, tt.atEnd)
+		}
+	}
+}
+
+func TestScheduleWindowOpen(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2019, 3, 2, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		start, end string
+		t          time.Time
+		want       bool
+	}{
+		{"01:00", "07:00", at(0, 59), false},
+		{"01:00", "07:00", at(1, 0), true},
+		{"01:00", "07:00", at(6, 59), true},
+		{"01:00", "07:00", at(7, 0), false},
+		{"23:00", "06:00", at(23, 30), true},
+		{"23:00", "06:00", at(3, 0), true},
+		{"23:00", "06:00", at(6, 0), false},
+		{"23:00", "06:00", at(12, 0), false},
+		{"00:00", "00:00", at(12, 0), true},
+	}
+	for _, tt := range tests {
+		w := &ScheduleWindow{Start: tt.start, End: tt.end}
+		if err := w.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Open(tt.t); got != tt.want {
+			t.Errorf("%v open at %v = %v, want %v", w, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestWindowFor(t *testing.T) {
+	conf := NewConfig()
+	conf.Profiles = []*Profile{{Name: "films", Channels: []string{"film4"}}}
+	conf.Schedule = []*ScheduleWindow{
+		{Profile: "films", Start: "02:00", End: "05:00"},
+		{Media: "video", Start: "01:00", End: "07:00"},
+	}
+	for _, p := range conf.Profiles {
+		if err := p.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, w := range conf.Schedule {
+		if err := w.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		job  TVHJob
+		want string
+	}{
+		{"profile window first", TVHJob{Filename: "a.ts", Channel: "Film4", Status: "OK"}, "02:00-05:00"},
+		{"media window", TVHJob{Filename: "a.ts", Channel: "BBC One", Status: "OK"}, "01:00-07:00"},
+		{"audio runs any time", TVHJob{Filename: "a.mka", Channel: "BBC Radio 4", Status: "OK"}, ""},
+		{"failed recordings never wait", TVHJob{Filename: "a.ts", Channel: "BBC One", Status: "Time missed"}, ""},
+		{"unknown media", TVHJob{Filename: "a.txt", Channel: "BBC One", Status: "OK"}, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if w := conf.WindowFor(&tt.job); w != nil {
+			got = w.String()
+		}
+		if got != tt.want {
+			t.Errorf("%v: got window %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
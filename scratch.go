@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+)
+
+// Temporary outputs are named by randomString(), a sha256 in hex.
+var tempOutputName = regexp.MustCompile(`^[0-9a-f]{64}\.[A-Za-z0-9]+$`)
+
+// Move a file, copying it if it has to cross filesystems, as it will
+// coming out of a local scratch directory.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	Log.Debug("%v and %v are on different filesystems, copying", src, dst)
+	if err := copyFile(context.Background(), src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Where to write a temporary output that will end up in dir.
+func (this *TranscodeJob) scratchPath(dir, name string) string {
+	if this.Conf.ScratchDir != "" {
+		dir = this.Conf.ScratchDir
+	}
+	return filepath.Join(dir, name)
+}
+
+// Create the scratch directory and clear out anything left in it by a
+// transcode that never finished. Only called at startup, after Recover()
+// and before the queue starts, when nothing can be using it. Files that
+// belong to an interrupted job whose original has gone are kept, as they
+// may be the only copy of the recording.
+func CleanScratchDir(dir string, db *Database) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	keep, err := db.unrecoverableTempPaths()
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !tempOutputName.MatchString(f.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		if keep[path] {
+			Log.Warning("Keeping scratch file %v, the original of its job is missing", path)
+			continue
+		}
+		Log.Warning("Removing orphaned scratch file %v", path)
+		if err := os.Remove(path); err != nil {
+			Log.Warning("Unable to remove %v: %v", path, err)
+		}
+	}
+	return nil
+}
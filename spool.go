@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Where `tvhtc submit` leaves jobs it couldn't get to the daemon, if
+// spool_dir isn't set. Under the unit's StateDirectory so systemd creates
+// it for us, owned by the user the daemon and TVHeadend run as.
+const defaultSpoolDir = "/var/lib/tvhtc/spool"
+
+const spoolInterval = time.Minute
+
+var shutdownSpool = make(chan bool)
+
+func (this *Config) SpoolPath() string {
+	this.RLock()
+	defer this.RUnlock()
+	if this.SpoolDir == "" {
+		return defaultSpoolDir
+	}
+	return this.SpoolDir
+}
+
+// Write a job into the spool. It's written under a temporary name and
+// renamed so the daemon never picks up half a file.
+func SpoolJob(dir string, job *TVHJob) (string, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return "", fmt.Errorf("Unable to create spool directory: %v", err)
+	}
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return "", fmt.Errorf("Unable to encode job: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, ".spool-")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create spool file: %v", err)
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Unable to write spool file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Unable to write spool file: %v", err)
+	}
+	path := filepath.Join(dir, job.IdempotencyKey+".json")
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Unable to write spool file: %v", err)
+	}
+	return path, nil
+}
+
+// Submit everything waiting in the spool. Jobs that are accepted (or were
+// already) are removed, ones that never will be are renamed to .rejected
+// and anything that failed on our side is left for next time.
+func ProcessSpool(conf *Config, db *Database) {
+	dir := conf.SpoolPath()
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	Log.Info("Picking up %v spooled jobs from %v", len(files), dir)
+	for _, f := range files {
+		raw, err := ioutil.ReadFile(f)
+		if err != nil {
+			Log.Warning("Unable to read spooled job %v: %v", f, err)
+			continue
+		}
+		job := &TVHJob{}
+		var serr *SubmitError
+		if err := json.Unmarshal(raw, job); err != nil {
+			serr = submitError(400, "Invalid job: %v", err)
+		} else {
+			if job.IdempotencyKey == "" {
+				job.IdempotencyKey = strings.TrimSuffix(filepath.Base(f), ".json")
+			}
+			var id int64
+			var existing bool
+			if id, existing, serr = SubmitJob(conf, db, job); serr == nil {
+				Log.Info("Spooled job for '%v' is job %v (already known: %v)", job.Path, id, existing)
+			}
+		}
+
+		switch {
+		case serr == nil:
+			if err := os.Remove(f); err != nil {
+				Log.Warning("Unable to remove spooled job %v: %v", f, err)
+			}
+		case serr.Code >= 500:
+			Log.Warning("Unable to submit spooled job %v, will try again: %v", f, serr)
+		default:
+			Log.Warning("Spooled job %v rejected: %v", f, serr)
+			if err := os.Rename(f, f+".rejected"); err != nil {
+				Log.Warning("Unable to set aside rejected job %v: %v", f, err)
+			}
+			conf.SendAlert("Spooled job rejected", fmt.Sprintf("The spooled job %v was rejected: %v", f, serr))
+		}
+	}
+}
+
+func StartSpoolWatcher(conf *Config, db *Database) {
+	dir := conf.SpoolPath()
+	Log.Warning("Spool watcher starting up, watching %v.", dir)
+	// The hook runs as TVHeadend's user, make sure it has somewhere to write
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		Log.Error("Unable to create spool directory %v: %v", dir, err)
+	}
+	go func() {
+		ticker := time.NewTicker(spoolInterval)
+		defer ticker.Stop()
+		for {
+			ProcessSpool(conf, db)
+			select {
+			case <-ticker.C:
+			case <-shutdownSpool:
+				Log.Warning("Spool watcher shutting down.")
+				return
+			}
+		}
+	}()
+}
+
+func StopSpoolWatcher() {
+	go func() {
+		shutdownSpool <- true
+	}()
+}
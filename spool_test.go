@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpoolJob(t *testing.T) {
+	tests := []struct {
+		name string
+		job  TVHJob
+	}{
+		{"plain", TVHJob{Path: "/r/a.ts", Title: "A", Status: "OK", IdempotencyKey: "key-a"}},
+		{"failed recording", TVHJob{Path: "/r/b.ts", Title: "B", Status: "Time missed", IdempotencyKey: "key-b"}},
+	}
+	for _, tt := range tests {
+		// Created if it isn't there
+		dir := filepath.Join(t.TempDir(), "spool")
+		path, err := SpoolJob(dir, &tt.job)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if path != filepath.Join(dir, tt.job.IdempotencyKey+".json") {
+			t.Errorf("%v: spooled to %v", tt.name, path)
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := TVHJob{}
+		if err := json.Unmarshal(raw, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.job {
+			t.Errorf("%v: read back %+v, want %+v", tt.name, got, tt.job)
+		}
+		// Nothing half written left behind
+		if leftovers, _ := filepath.Glob(filepath.Join(dir, ".spool-*")); len(leftovers) > 0 {
+			t.Errorf("%v: temporary files left: %v", tt.name, leftovers)
+		}
+	}
+}
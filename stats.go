@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Upper bounds of the queue wait buckets. Anything longer goes in the
+// last, open-ended one.
+var waitBuckets = []time.Duration{
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// Summary of a set of jobs. Failure rate is failed jobs (failed
+// recordings included) over finished ones. Bytes saved and compression
+// ratio (output size / input size) only count successful transcodes, as
+// does speed, which is seconds of recording transcoded per second. Jobs
+// from before success was recorded count as successful if they left an
+// output behind, see the backfill in transcodeColumns.
+type StatsGroup struct {
+	Recordings       int     `json:"recordings"`
+	Completed        int     `json:"completed"`
+	Failed           int     `json:"failed"`
+	FailureRate      float64 `json:"failure_rate"`
+	BytesBefore      int64   `json:"bytes_before"`
+	BytesAfter       int64   `json:"bytes_after"`
+	BytesSaved       int64   `json:"bytes_saved"`
+	CompressionRatio float64 `json:"avg_compression_ratio"`
+	Speed            float64 `json:"avg_speed"`
+	ratios           float64
+	nratios          int
+	mediaSeconds     float64
+	encodeSeconds    float64
+}
+
+type WaitBucket struct {
+	Under time.Duration `json:"under"`
+	Count int           `json:"count"`
+}
+
+// How long jobs sat in the queue before starting.
+type WaitStats struct {
+	Jobs    int           `json:"jobs"`
+	Median  time.Duration `json:"median"`
+	P90     time.Duration `json:"p90"`
+	Max     time.Duration `json:"max"`
+	Buckets []WaitBucket  `json:"buckets"`
+	Over    int           `json:"over"`
+}
+
+type Stats struct {
+	Totals    *StatsGroup            `json:"totals"`
+	ByChannel map[string]*StatsGroup `json:"by_channel"`
+	ByTitle   map[string]*StatsGroup `json:"by_title"`
+	ByMonth   map[string]*StatsGroup `json:"by_month"`
+	QueueWait WaitStats              `json:"queue_wait"`
+}
+
+// One row's worth of job, as much as the stats need.
+type statsRow struct {
+	channel, title     string
+	completed, success bool
+	before, after      int64
+	elapsed            time.Duration
+	duration           *float64
+	queued             time.Time
+	started            *time.Time
+}
+
+func (this *StatsGroup) add(r *statsRow) {
+	this.Recordings++
+	if !r.completed {
+		return
+	}
+	this.Completed++
+	if !r.success {
+		this.Failed++
+		return
+	}
+	this.BytesBefore += r.before
+	this.BytesAfter += r.after
+	if r.before > 0 && r.after > 0 {
+		this.ratios += float64(r.after) / float64(r.before)
+		this.nratios++
+	}
+	if r.duration != nil && *r.duration > 0 && r.elapsed > 0 {
+		this.mediaSeconds += *r.duration
+		this.encodeSeconds += r.elapsed.Seconds()
+	}
+}
+
+func (this *StatsGroup) finish() {
+	if this.Completed > 0 {
+		this.FailureRate = float64(this.Failed) / float64(this.Completed)
+	}
+	this.BytesSaved = this.BytesBefore - this.BytesAfter
+	if this.nratios > 0 {
+		this.CompressionRatio = this.ratios / float64(this.nratios)
+	}
+	if this.encodeSeconds > 0 {
+		this.Speed = this.mediaSeconds / this.encodeSeconds
+	}
+}
+
+func groupFor(groups map[string]*StatsGroup, key string) *StatsGroup {
+	g, ok := groups[key]
+	if !ok {
+		g = &StatsGroup{}
+		groups[key] = g
+	}
+	return g
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func waitStats(waits []time.Duration) WaitStats {
+	sort.Slice(waits, func(i, j int) bool { return waits[i] < waits[j] })
+	ws := WaitStats{Jobs: len(waits), Buckets: make([]WaitBucket, len(waitBuckets))}
+	for i, b := range waitBuckets {
+		ws.Buckets[i].Under = b
+	}
+	for _, w := range waits {
+		i := sort.Search(len(waitBuckets), func(i int) bool { return w < waitBuckets[i] })
+		if i == len(waitBuckets) {
+			ws.Over++
+		} else {
+			ws.Buckets[i].Count++
+		}
+	}
+	if len(waits) > 0 {
+		ws.Median = percentile(waits, 0.5)
+		ws.P90 = percentile(waits, 0.9)
+		ws.Max = waits[len(waits)-1]
+	}
+	return ws
+}
+
+// Work out the stats for jobs queued between from and to. Zero times
+// leave that end open.
+func (this *Database) Stats(from, to time.Time) (*Stats, error) {
+	where, args := "1=1", []interface{}{}
+	if !from.IsZero() {
+		where += " AND julianday(initialqueuetime) >= julianday(?)"
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		where += " AND julianday(initialqueuetime) < julianday(?)"
+		args = append(args, to)
+	}
+	rows, err := this.db.Query(`SELECT channel, title, completed, success, sizebefore, sizeafter, elapsedtime,
+								duration, initialqueuetime, starttime FROM transcodes WHERE `+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	stats := &Stats{
+		Totals:    &StatsGroup{},
+		ByChannel: make(map[string]*StatsGroup),
+		ByTitle:   make(map[string]*StatsGroup),
+		ByMonth:   make(map[string]*StatsGroup),
+	}
+	waits := make([]time.Duration, 0)
+	for rows.Next() {
+		r := &statsRow{}
+		var elapsed int64
+		if err := rows.Scan(&r.channel, &r.title, &r.completed, &r.success, &r.before, &r.after, &elapsed,
+			&r.duration, &r.queued, &r.started); err != nil {
+			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		r.elapsed = time.Duration(elapsed)
+
+		stats.Totals.add(r)
+		groupFor(stats.ByChannel, r.channel).add(r)
+		groupFor(stats.ByTitle, r.title).add(r)
+		groupFor(stats.ByMonth, r.queued.Local().Format("2006-01")).add(r)
+		if r.started != nil && r.started.After(r.queued) {
+			waits = append(waits, r.started.Sub(r.queued))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error retrieving stats: %v", err)
+	}
+
+	stats.Totals.finish()
+	for _, groups := range []map[string]*StatsGroup{stats.ByChannel, stats.ByTitle, stats.ByMonth} {
+		for _, g := range groups {
+			g.finish()
+		}
+	}
+	stats.QueueWait = waitStats(waits)
+	return stats, nil
+}
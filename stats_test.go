@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	d := testDatabase(t)
+	_, err := d.db.Exec(`INSERT INTO transcodes (channel, title, completed, success, elapsedtime, initialqueuetime, sizebefore, sizeafter) VALUES
+			('BBC One', 'News', 1, 1, 0, '2019-01-05 10:00:00', 1000, 400),
+			('BBC One', 'News', 1, 1, 0, '2019-01-06 10:00:00', 1000, 600),
+			('ITV', 'Quiz', 1, 0, 0, '2019-02-01 10:00:00', 1000, 0),
+			('ITV', 'Quiz', 0, 0, 0, '2019-02-02 10:00:00', 1000, 0);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := d.Stats(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                          string
+		group                         *StatsGroup
+		recordings, completed, failed int
+		saved                         int64
+	}{
+		{"totals", stats.Totals, 4, 3, 1, 1000},
+		{"BBC One", stats.ByChannel["BBC One"], 2, 2, 0, 1000},
+		{"ITV", stats.ByChannel["ITV"], 2, 1, 1, 0},
+	}
+	for _, tt := range tests {
+		g := tt.group
+		if g == nil {
+			t.Errorf("%v: missing", tt.name)
+			continue
+		}
+		if g.Recordings != tt.recordings || g.Completed != tt.completed || g.Failed != tt.failed || g.BytesSaved != tt.saved {
+			t.Errorf("%v: got %v recordings, %v completed, %v failed, %v saved, want %v, %v, %v, %v", tt.name,
+				g.Recordings, g.Completed, g.Failed, g.BytesSaved, tt.recordings, tt.completed, tt.failed, tt.saved)
+		}
+	}
+	if r := stats.ByChannel["BBC One"].CompressionRatio; r != 0.5 {
+		t.Errorf("BBC One compression ratio = %v, want 0.5", r)
+	}
+}
+
+func TestStatsCountsLegacyHistory(t *testing.T) {
+	// Jobs from before the success column, as the backfill finds them
+	d := testDatabase(t,
+		`CREATE TABLE transcodes (
+			id INTEGER NOT NULL PRIMARY KEY, path TEXT,
+			filename TEXT, channel TEXT, title TEXT,
+			status TEXT, description TEXT, completed INTEGER, message TEXT,
+			elapsedtime INTEGER, initialqueuetime DATETIME,
+			completetime DATETIME, sizebefore INTEGER, sizeafter INTEGER);`,
+		`INSERT INTO transcodes (channel, title, completed, elapsedtime, initialqueuetime, sizebefore, sizeafter) VALUES
+			('BBC One', 'News', 1, 0, '2019-01-05 10:00:00', 1000, 400),
+			('BBC One', 'News', 1, 0, '2019-01-06 10:00:00', 1000, 600),
+			('ITV', 'Quiz', 1, 0, '2019-02-01 10:00:00', 1000, 0),
+			('ITV', 'Quiz', 0, 0, '2019-02-02 10:00:00', 1000, 0);`,
+	)
+	stats, err := d.Stats(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                          string
+		group                         *StatsGroup
+		recordings, completed, failed int
+		saved                         int64
+	}{
+		{"totals", stats.Totals, 4, 3, 1, 1000},
+		{"BBC One", stats.ByChannel["BBC One"], 2, 2, 0, 1000},
+		{"ITV", stats.ByChannel["ITV"], 2, 1, 1, 0},
+	}
+	for _, tt := range tests {
+		g := tt.group
+		if g == nil {
+			t.Errorf("%v: missing", tt.name)
+			continue
+		}
+		if g.Recordings != tt.recordings || g.Completed != tt.completed || g.Failed != tt.failed || g.BytesSaved != tt.saved {
+			t.Errorf("%v: got %v recordings, %v completed, %v failed, %v saved, want %v, %v, %v, %v", tt.name,
+				g.Recordings, g.Completed, g.Failed, g.BytesSaved, tt.recordings, tt.completed, tt.failed, tt.saved)
+		}
+	}
+	if r := stats.ByChannel["BBC One"].CompressionRatio; r != 0.5 {
+		t.Errorf("BBC One compression ratio = %v, want 0.5", r)
+	}
+}
+
+func TestWaitStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		waits   []time.Duration
+		median  time.Duration
+		over    int
+		buckets []int
+	}{
+		{"none", nil, 0, 0, []int{0, 0, 0, 0, 0}},
+		{"one quick", []time.Duration{30 * time.Second}, 30 * time.Second, 0, []int{1, 0, 0, 0, 0}},
+		{
+			"spread",
+			[]time.Duration{2 * time.Hour, time.Second, 5 * time.Minute, 48 * time.Hour},
+			5 * time.Minute, 1, []int{1, 1, 0, 1, 0},
+		},
+	}
+	for _, tt := range tests {
+		ws := waitStats(tt.waits)
+		if ws.Median != tt.median || ws.Over != tt.over {
+			t.Errorf("%v: median %v, over %v, want %v, %v", tt.name, ws.Median, ws.Over, tt.median, tt.over)
+		}
+		for i, want := range tt.buckets {
+			if ws.Buckets[i].Count != want {
+				t.Errorf("%v: bucket under %v has %v, want %v", tt.name, ws.Buckets[i].Under, ws.Buckets[i].Count, want)
+			}
+		}
+	}
+}
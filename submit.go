@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Held while checking for a duplicate and adding the job, so two copies
+// of the same submission arriving together can't both get in.
+var submitLock sync.Mutex
+
+// Identifies the recording a job is for. TVHeadend reruns the
+// post-processor for the same file, which keeps its inode and mtime; a new
+// recording at the same path won't. Failed recordings often have no file,
+// so those go on path and status.
+func jobFingerprint(job *TVHJob) (string, *time.Time) {
+	st, err := os.Stat(job.Path)
+	if err != nil {
+		return fmt.Sprintf("%v|%v", job.Path, job.Status), nil
+	}
+	mtime := st.ModTime()
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%v|%v:%v|%v", job.Path, sys.Dev, sys.Ino, mtime.UnixNano()), &mtime
+	}
+	return fmt.Sprintf("%v|%v|%v", job.Path, st.Size(), mtime.UnixNano()), &mtime
+}
+
+// Look for a job that this one repeats. That's one with the same
+// idempotency key or fingerprint, or one whose output is now the file
+// being submitted (we replaced the recording with our transcode), or
+// any job for the path if the file's gone (we moved it). Returns 0 if
+// there isn't one.
+func (this *Database) FindDuplicate(job *TVHJob, mtime *time.Time) (int64, error) {
+	var id int64
+	err := this.db.QueryRow(`SELECT id FROM transcodes WHERE (idempotencykey=? AND idempotencykey != '')
+							 OR fingerprint=? ORDER BY id DESC LIMIT 1`, job.IdempotencyKey, job.Fingerprint).Scan(&id)
+	if err == nil || err != sql.ErrNoRows {
+		return id, err
+	}
+
+	if mtime != nil {
+		err = this.db.QueryRow(`SELECT id FROM transcodes WHERE outputpath=? AND success=1
+								AND julianday(completetime) >= julianday(?) ORDER BY id DESC LIMIT 1`,
+			job.Path, *mtime).Scan(&id)
+	} else {
+		err = this.db.QueryRow("SELECT id FROM transcodes WHERE path=? ORDER BY id DESC LIMIT 1", job.Path).Scan(&id)
+	}
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Check, record and queue a submitted job. Duplicates aren't queued again,
+// the existing job's ID is returned instead with existing set.
+func SubmitJob(conf *Config, db *Database, job *TVHJob) (id int64, existing bool, serr *SubmitError) {
+	if serr = conf.ValidateJob(job); serr != nil {
+		return 0, false, serr
+	}
+
+	submitLock.Lock()
+	defer submitLock.Unlock()
+
+	var mtime *time.Time
+	job.Fingerprint, mtime = jobFingerprint(job)
+	dup, err := db.FindDuplicate(job, mtime)
+	if err != nil {
+		return 0, false, submitError(500, "Error checking for duplicate job: %v", err)
+	}
+	if dup != 0 {
+		Log.Info("Job for '%v' is a duplicate of job %v, not queueing it again", job.Path, dup)
+		return dup, true, nil
+	}
+
+	if serr = CheckRecording(job); serr != nil {
+		return 0, false, serr
+	}
+	conf.AssignPriority(job)
+	if job.DBID, err = db.AddEntry(job); err != nil {
+		return 0, false, submitError(500, "%v", err)
+	}
+	Transcode(job)
+	return job.DBID, false, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "news.ts")
+	if err := ioutil.WriteFile(path, []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := jobFingerprint(&TVHJob{Path: path, Status: "OK"})
+	missing := filepath.Join(dir, "gone.ts")
+
+	tests := []struct {
+		name     string
+		setup    func()
+		job      *TVHJob
+		want     string
+		same     bool
+		hasMtime bool
+	}{
+		{
+			name:     "rerun for the same file",
+			job:      &TVHJob{Path: path, Status: "OK"},
+			same:     true,
+			hasMtime: true,
+		},
+		{
+			name: "new recording at the same path",
+			setup: func() {
+				other := filepath.Join(dir, "other.ts")
+				later := time.Now().Add(time.Hour)
+				ioutil.WriteFile(other, []byte("two"), 0644)
+				os.Chtimes(other, later, later)
+				os.Rename(other, path)
+			},
+			job:      &TVHJob{Path: path, Status: "OK"},
+			hasMtime: true,
+		},
+		{
+			name: "missing file",
+			job:  &TVHJob{Path: missing, Status: "Time missed"},
+			want: missing + "|Time missed",
+		},
+	}
+	for _, tt := range tests {
+		if tt.setup != nil {
+			tt.setup()
+		}
+		fp, mtime := jobFingerprint(tt.job)
+		if (fp == first) != tt.same || (mtime != nil) != tt.hasMtime || (tt.want != "" && fp != tt.want) {
+			t.Errorf("%v: fingerprint %q (mtime %v), first was %q", tt.name, fp, mtime, first)
+		}
+	}
+}
+
+func TestFindDuplicate(t *testing.T) {
+	db := testDatabase(t)
+	add := func(job TVHJob) int64 {
+		id, err := db.AddEntry(&job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	keyed := add(TVHJob{Path: "/r/a.ts", IdempotencyKey: "key-a", Fingerprint: "fp-a"})
+	printed := add(TVHJob{Path: "/r/b.ts", Fingerprint: "fp-b"})
+	failed := add(TVHJob{Path: "/r/missed.ts", Status: "Time missed", Fingerprint: "/r/missed.ts|Time missed"})
+	replaced := add(TVHJob{Path: "/r/c.ts", Fingerprint: "fp-c"})
+	done := time.Date(2019, 3, 2, 22, 0, 0, 0, time.UTC)
+	if _, err := db.db.Exec("UPDATE transcodes SET outputpath=?, success=1, completed=1, completetime=? WHERE id=?",
+		"/r/c.mkv", done, replaced); err != nil {
+		t.Fatal(err)
+	}
+	unfinished := add(TVHJob{Path: "/r/d.ts", Fingerprint: "fp-d"})
+	db.db.Exec("UPDATE transcodes SET outputpath=? WHERE id=?", "/r/d.mkv", unfinished)
+
+	before := done.Add(-time.Hour)
+	after := done.Add(time.Hour)
+	tests := []struct {
+		name  string
+		job   TVHJob
+		mtime *time.Time
+		want  int64
+	}{
+		{"same key", TVHJob{Path: "/r/elsewhere.ts", IdempotencyKey: "key-a", Fingerprint: "new"}, &before, keyed},
+		{"same fingerprint", TVHJob{Path: "/r/b.ts", IdempotencyKey: "key-new", Fingerprint: "fp-b"}, &before, printed},
+		{"empty key matches nothing", TVHJob{Path: "/r/new.ts", Fingerprint: "new"}, &before, 0},
+		{"our own output", TVHJob{Path: "/r/c.mkv", Fingerprint: "new"}, &before, replaced},
+		{"output rewritten since", TVHJob{Path: "/r/c.mkv", Fingerprint: "new"}, &after, 0},
+		{"output of an unfinished job", TVHJob{Path: "/r/d.mkv", Fingerprint: "new"}, &before, 0},
+		{"file gone, same path", TVHJob{Path: "/r/a.ts", Fingerprint: "new"}, nil, keyed},
+		{"failed recording resent", TVHJob{Path: "/r/missed.ts", Status: "Time missed", Fingerprint: "/r/missed.ts|Time missed"}, nil, failed},
+		{"new file at an old path", TVHJob{Path: "/r/b.ts", Fingerprint: "fp-b2"}, &before, 0},
+	}
+	for _, tt := range tests {
+		got, err := db.FindDuplicate(&tt.job, tt.mtime)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: got job %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	SUBTITLES_NONE    = "none"
+	SUBTITLES_EXTRACT = "extract"
+	SUBTITLES_MUX     = "mux"
+)
+
+// Subtitle codecs we can turn into SRT. Teletext needs ffmpeg built with
+// libzvbi, and has to be told to decode to text rather than bitmaps.
+var textSubtitleCodecs = map[string]bool{
+	"dvb_teletext": true,
+	"subrip":       true,
+	"ass":          true,
+	"ssa":          true,
+	"mov_text":     true,
+	"webvtt":       true,
+}
+
+func validSubtitleMode(mode string) bool {
+	switch mode {
+	case "", SUBTITLES_NONE, SUBTITLES_EXTRACT, SUBTITLES_MUX:
+		return true
+	}
+	return false
+}
+
+func (this *TranscodeJob) subtitleMode() string {
+	if this.Type != MEDIA_VIDEO || this.Profile == nil || this.Profile.Subtitles == "" {
+		return SUBTITLES_NONE
+	}
+	return this.Profile.Subtitles
+}
+
+// Subtitle streams in the source, in the order ffmpeg numbers them for
+// 0:s:N stream specifiers.
+func (this *TranscodeJob) subtitleStreams() []ProbeStream {
+	src, err := this.ProbeSource()
+	if err != nil {
+		Log.Warning("Unable to probe '%v' for subtitles: %v", this.Job.Path, err)
+		return nil
+	}
+	subs := make([]ProbeStream, 0)
+	for _, st := range src.Streams {
+		if st.CodecType == "subtitle" {
+			subs = append(subs, st)
+		}
+	}
+	return subs
+}
+
+func hasTeletext(subs []ProbeStream) bool {
+	for _, st := range subs {
+		if st.CodecName == "dvb_teletext" {
+			return true
+		}
+	}
+	return false
+}
+
+// When muxing, drop the -sn from the transcode settings and map every
+// subtitle stream into the output. Text subs are converted to SRT,
+// bitmap subs are copied as they are, which mkv is happy to carry.
+func (this *TranscodeJob) subtitleArgs(inputs, opts []string) ([]string, []string) {
+	if this.subtitleMode() != SUBTITLES_MUX {
+		return inputs, opts
+	}
+	subs := this.subtitleStreams()
+	if len(subs) == 0 {
+		return inputs, opts
+	}
+
+	filtered := make([]string, 0, len(opts))
+	for _, o := range opts {
+		if o != "-sn" {
+			filtered = append(filtered, o)
+		}
+	}
+	opts = append(filtered, "-map", "0:v", "-map", "0:a?", "-map", "0:s")
+	for i, st := range subs {
+		codec := "copy"
+		if textSubtitleCodecs[st.CodecName] {
+			codec = "srt"
+		}
+		opts = append(opts, fmt.Sprintf("-c:s:%d", i), codec)
+	}
+
+	if hasTeletext(subs) {
+		// Input option, has to go before the -i it applies to
+		inputs = append([]string{"-txt_format", "text"}, inputs...)
+	}
+	Log.Debug("Muxing %d subtitle stream(s) into output", len(subs))
+	return inputs, opts
+}
+
+// Pick the sidecar extension for a subtitle stream. ffmpeg can only write
+// .sup for streams that are already PGS, other bitmap formats (DVB subs,
+// mostly) go in a Matroska subtitle file instead.
+func subtitleSidecar(st ProbeStream) (ext, codec string) {
+	switch {
+	case textSubtitleCodecs[st.CodecName]:
+		return "srt", "srt"
+	case st.CodecName == "hdmv_pgs_subtitle":
+		return "sup", "copy"
+	default:
+		return "mks", "copy"
+	}
+}
+
+// Write each subtitle stream from the source to a sidecar file next to
+// the output, named the way Kodi and Jellyfin look for them.
+func (this *TranscodeJob) ExtractSubtitles(ctx context.Context) error {
+	if this.subtitleMode() != SUBTITLES_EXTRACT {
+		return nil
+	}
+	subs := this.subtitleStreams()
+	if len(subs) == 0 {
+		return nil
+	}
+	if this.CommercialAction == COMMERCIAL_CUT {
+		Log.Warning("Adverts were cut from '%v' but subtitle sidecars are extracted uncut", this.Job.Title)
+	}
+
+	errors := make([]string, 0)
+	seen := make(map[string]int)
+	for i, st := range subs {
+		ext, codec := subtitleSidecar(st)
+		lang := st.Tags["language"]
+		if lang == "" {
+			lang = "und"
+		}
+		name := fmt.Sprintf("%v.%v", this.sidecarBase(), lang)
+		seen[name]++
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%v.%d", name, seen[name])
+		}
+		path := fmt.Sprintf("%v.%v", name, ext)
+
+		args := []string{}
+		if st.CodecName == "dvb_teletext" {
+			args = append(args, "-txt_format", "text")
+		}
+		args = append(args, "-i", this.Job.Path, "-map", fmt.Sprintf("0:s:%d", i), "-c:s", codec, "-y", path)
+		Log.Debug("Executing command ffmpeg with arguments: %+v", args)
+		if out, err := this.RunFFmpegContext(ctx, args); err != nil {
+			errors = append(errors, fmt.Sprintf("stream %d (%v): %v: %s", st.Index, st.CodecName, err, lastLine(out)))
+			continue
+		}
+		Log.Info("Extracted %v subtitles to %v", st.CodecName, path)
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("Subtitle extraction failed for %v", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+// ffmpeg puts the useful part of an error at the end of a lot of noise.
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}
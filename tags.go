@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Default tag templates, used for any not set in the config.
+var defaultTagTemplates = map[string]string{
+	"title":   "{Title}",
+	"artist":  "{Channel}",
+	"album":   "{Channel}",
+	"comment": "{Description}",
+	"date":    "{date}",
+}
+
+// Image extensions we'll look for in the cover directory.
+var coverExtensions = []string{".jpg", ".jpeg", ".png"}
+
+// ID3v2 tagging for audio outputs. Tags maps tag names (title, artist,
+// album, comment, date, genre...) to templates using the same fields as
+// the output path templates. Cover art is looked up in CoverDir by
+// channel name, e.g. "BBC Radio 4.jpg", falling back to "default.jpg".
+type TagSettings struct {
+	Enabled  bool              `yaml:"enabled"`
+	CoverDir string            `yaml:"cover_dir"`
+	Tags     map[string]string `yaml:"tags"`
+}
+
+// Find the cover image for a channel, or "" if there isn't one.
+func (this *TagSettings) coverFor(channel string) string {
+	if this.CoverDir == "" {
+		return ""
+	}
+	name := SanitiseFilename(channel)
+	for _, base := range []string{name, strings.ToLower(name), "default"} {
+		for _, ext := range coverExtensions {
+			path := filepath.Join(this.CoverDir, base+ext)
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// Add ID3 tags, and cover art if we have some for the channel, to mp3
+// outputs.
+func (this *TranscodeJob) tagArgs(inputs, opts []string) ([]string, []string) {
+	ts := &this.Conf.Tags
+	if !ts.Enabled || this.Type != MEDIA_AUDIO || strings.ToLower(filepath.Ext(this.TempPath)) != ".mp3" {
+		return inputs, opts
+	}
+
+	opts = append(opts, this.tagMetadata()...)
+
+	if cover := ts.coverFor(this.Job.Channel); cover != "" {
+		Log.Debug("Using cover art %v for '%v'", cover, this.Job.Channel)
+		n := countInputs(inputs)
+		inputs = append(inputs, "-i", cover)
+		opts = append(opts, "-map", "0:a", "-map", fmt.Sprintf("%d:v", n), "-c:v", "copy",
+			"-metadata:s:v", "title=Album cover", "-metadata:s:v", "comment=Cover (front)")
+	}
+	return inputs, opts
+}
+
+// The -metadata options for the configured tag templates.
+func (this *TranscodeJob) tagMetadata() []string {
+	templates := make(map[string]string)
+	for k, v := range defaultTagTemplates {
+		templates[k] = v
+	}
+	for k, v := range this.Conf.Tags.Tags {
+		templates[k] = v
+	}
+	// Stable ordering keeps the logged command line readable
+	names := make([]string, 0, len(templates))
+	for k := range templates {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	opts := []string{"-id3v2_version", "3"}
+	for _, k := range names {
+		if v := this.ExpandTagTemplate(templates[k]); v != "" {
+			opts = append(opts, "-metadata", fmt.Sprintf("%v=%v", k, v))
+		}
+	}
+	return opts
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoverFor(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"BBC Radio 4.jpg", "classic fm.png", "default.jpg"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		coverDir string
+		channel  string
+		want     string
+	}{
+		{"exact name", dir, "BBC Radio 4", "BBC Radio 4.jpg"},
+		{"lower case", dir, "Classic FM", "classic fm.png"},
+		{"sanitised", dir, "BBC Radio 4/", "BBC Radio 4.jpg"},
+		{"default", dir, "Radio X", "default.jpg"},
+		{"no cover dir", "", "BBC Radio 4", ""},
+	}
+	for _, tt := range tests {
+		ts := &TagSettings{CoverDir: tt.coverDir}
+		got := ts.coverFor(tt.channel)
+		if tt.want != "" {
+			tt.want = filepath.Join(dir, tt.want)
+		}
+		if got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTagArgs(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "default.jpg")
+	if err := ioutil.WriteFile(cover, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	recorded := time.Date(2019, 3, 2, 20, 30, 0, 0, time.UTC)
+	job := &TVHJob{Title: "The Archers", Channel: "BBC Radio 4", Description: "Ambridge"}
+
+	tests := []struct {
+		name     string
+		settings TagSettings
+		media    MediaType
+		temp     string
+		inputs   []string
+		opts     []string
+	}{
+		{
+			name:     "disabled",
+			settings: TagSettings{},
+			media:    MEDIA_AUDIO,
+			temp:     "/tmp/x.mp3",
+			inputs:   []string{"-i", "in.ts"},
+			opts:     []string{"-c:a", "libmp3lame"},
+		},
+		{
+			name:     "not mp3",
+			settings: TagSettings{Enabled: true},
+			media:    MEDIA_AUDIO,
+			temp:     "/tmp/x.m4a",
+			inputs:   []string{"-i", "in.ts"},
+			opts:     []string{"-c:a", "aac"},
+		},
+		{
+			name:     "tags with overrides",
+			settings: TagSettings{Enabled: true, Tags: map[string]string{"album": "{Title}", "genre": "Radio", "comment": ""}},
+			media:    MEDIA_AUDIO,
+			temp:     "/tmp/x.MP3",
+			inputs:   []string{"-i", "in.ts"},
+			opts: []string{"-c:a", "libmp3lame", "-id3v2_version", "3",
+				"-metadata", "album=The Archers", "-metadata", "artist=BBC Radio 4",
+				"-metadata", "date=2019-03-02", "-metadata", "genre=Radio", "-metadata", "title=The Archers"},
+		},
+		{
+			name:     "cover art",
+			settings: TagSettings{Enabled: true, CoverDir: dir, Tags: map[string]string{"title": "", "artist": "", "album": "", "comment": "", "date": ""}},
+			media:    MEDIA_AUDIO,
+			temp:     "/tmp/x.mp3",
+			inputs:   []string{"-i", "in.ts", "-i", cover},
+			opts: []string{"-c:a", "libmp3lame", "-id3v2_version", "3",
+				"-map", "0:a", "-map", "1:v", "-c:v", "copy",
+				"-metadata:s:v", "title=Album cover", "-metadata:s:v", "comment=Cover (front)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := NewConfig()
+			conf.Tags = tt.settings
+			tc := &TranscodeJob{Job: job, Conf: &conf, Type: tt.media, TempPath: tt.temp, RecordedAt: recorded}
+			inputs, opts := tc.tagArgs([]string{"-i", "in.ts"}, []string{tt.opts[0], tt.opts[1]})
+			if !reflect.DeepEqual(inputs, tt.inputs) {
+				t.Errorf("inputs: got %v, want %v", inputs, tt.inputs)
+			}
+			if !reflect.DeepEqual(opts, tt.opts) {
+				t.Errorf("opts:\ngot  %v\nwant %v", strings.Join(opts, " "), strings.Join(tt.opts, " "))
+			}
+		})
+	}
+}
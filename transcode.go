@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -24,23 +23,39 @@ const (
 )
 
 type TranscodeJob struct {
-	Job          *TVHJob
-	TempFilename string
-	TempPath     string
-	Keep         bool
-	Success      bool
-	Rename       bool
-	Type         MediaType
-	Message      string
-	Handlers     []Notifier
-	Conf         *Config
-	OldSize      int64
-	NewSize      int64
-	ElapsedTime  time.Duration
+	Job              *TVHJob
+	TempFilename     string
+	TempPath         string
+	OutputPath       string
+	RecordedAt       time.Time
+	Keep             bool
+	Success          bool
+	Rename           bool
+	Type             MediaType
+	Message          string
+	Handlers         []Notifier
+	Conf             *Config
+	DB               *Database
+	OldSize          int64
+	NewSize          int64
+	ElapsedTime      time.Duration
+	SourceProbe      *ProbeResult
+	Profile          *Profile
+	PostResults      []PostStepResult
+	Commercials      []Segment
+	CommercialAction string
+	Encode           *EncodeParams
+	Renditions       []*Rendition
+	Loudness         *Loudness
+	LoudnessTargets  *LoudnessSettings
+	chapterInput     int
+	chapterFile      string
+	scratchFiles     []string
+	progress         *jobProgress
 }
 
-func NewTranscodeJob(job *TVHJob, conf *Config) TranscodeJob {
-	return TranscodeJob{Job: job, Conf: conf}
+func NewTranscodeJob(job *TVHJob, conf *Config, db *Database) TranscodeJob {
+	return TranscodeJob{Job: job, Conf: conf, DB: db, progress: &jobProgress{}}
 }
 
 // Figures out who needs a notification when this job completes.
@@ -79,6 +94,7 @@ func (this *TranscodeJob) SendNotifications() error {
 
 	for i := range this.Handlers {
 		err := this.Handlers[i].Send(this)
+		metrics.notified(this.Handlers[i], err)
 		if err != nil {
 			errors = append(errors, err.Error())
 		}
@@ -116,18 +132,43 @@ func (this *TranscodeJob) DetermineType() error {
 	return nil
 }
 
-// Remove the original file and rename the transcoded file from the
-// temporary name into the original name. Mainly for videos as we're
-// just re-encoding .mkv -> .mkv
+// Move the transcoded file from its temporary name to the output path and
+// get rid of the original. Without an output template that's the original
+// name, as we're just re-encoding .mkv -> .mkv. The output is brought into
+// the destination directory first (copied, if it's coming from scratch on
+// another filesystem) so the original is only removed once there's a
+// complete output next to where it's going.
 func (this *TranscodeJob) DoRename() error {
-	if this.Rename && !this.Keep {
-		Log.Debug("Doing rename %v -> %v", this.TempPath, this.Job.Path)
-		if err := os.Remove(this.Job.Path); err != nil {
-			return err
+	if !this.Rename {
+		return nil
+	}
+	if this.Keep && this.OutputPath == this.Job.Path {
+		// Can't put the output where the original is if we're keeping it
+		return nil
+	}
+
+	staged := filepath.Join(filepath.Dir(this.OutputPath), this.TempFilename)
+	if staged != this.TempPath {
+		// Recovery cleans this up if we die before the original's gone
+		if err := this.DB.SetTempPaths(this.Job.DBID, append(this.tempPaths(), staged)); err != nil {
+			Log.Warning(err.Error())
 		}
-		if err := os.Rename(this.TempPath, this.Job.Path); err != nil {
-			return err
+		Log.Debug("Staging %v at %v", this.TempPath, staged)
+		if err := moveFile(this.TempPath, staged); err != nil {
+			os.Remove(staged)
+			return fmt.Errorf("Unable to move output into '%v': %v", filepath.Dir(this.OutputPath), err)
 		}
+		this.TempPath = staged
+	}
+
+	if !this.Keep {
+		if err := this.DB.TrashOriginal(this.Conf, this.Job.DBID, this.Job.Path, this.OutputPath); err != nil {
+			return fmt.Errorf("Unable to remove original, output left at '%v': %v", staged, err)
+		}
+	}
+	Log.Debug("Doing rename %v -> %v", staged, this.OutputPath)
+	if err := os.Rename(staged, this.OutputPath); err != nil {
+		return fmt.Errorf("Unable to rename output into place, it's at '%v': %v", staged, err)
 	}
 	return nil
 }
@@ -136,8 +177,7 @@ func (this *TranscodeJob) DoRename() error {
 // to remove the original file and leave new .mp3 file alone.
 func (this *TranscodeJob) Cleanup() error {
 	if !this.Rename && !this.Keep && this.Type == MEDIA_AUDIO {
-		Log.Debug("Removing %v", this.Job.Path)
-		if err := os.Remove(this.Job.Path); err != nil {
+		if err := this.DB.TrashOriginal(this.Conf, this.Job.DBID, this.Job.Path, this.OutputPath); err != nil {
 			return err
 		}
 	}
@@ -153,6 +193,21 @@ func (this *TranscodeJob) GenerateTranscodeName() error {
 	if err := this.DetermineType(); err != nil {
 		return err
 	}
+	this.Profile = this.Conf.ProfileFor(this.Job, this.Type)
+
+	if out := this.TemplatedOutputPath(); out != "" {
+		// Without a scratch directory write into the destination
+		// directory so the final rename doesn't cross filesystems.
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return fmt.Errorf("Unable to create output directory: %v", err)
+		}
+		this.Rename = true
+		this.OutputPath = AvoidCollision(out)
+		this.TempFilename = fmt.Sprintf("%v%v", this.randomString(), filepath.Ext(out))
+		this.TempPath = this.scratchPath(filepath.Dir(this.OutputPath), this.TempFilename)
+		Log.Debug("Templated output path: %v, temporary path: %v", this.OutputPath, this.TempPath)
+		return nil
+	}
 
 	if this.Type == MEDIA_VIDEO {
 		this.Rename = true
@@ -166,6 +221,18 @@ func (this *TranscodeJob) GenerateTranscodeName() error {
 		Log.Debug("MEDIA_AUDIO temporary filename: %v", this.TempFilename)
 	}
 	this.TempPath = fmt.Sprintf("%v/%v", filepath.Dir(this.Job.Path), this.TempFilename)
+	if this.Rename {
+		this.OutputPath = this.Job.Path
+	} else {
+		this.OutputPath = this.TempPath
+	}
+	if this.Conf.ScratchDir != "" {
+		// Audio gets written straight to its final name otherwise, so
+		// it needs a temporary name and a rename too.
+		this.Rename = true
+		this.TempFilename = fmt.Sprintf("%v%v", this.randomString(), filepath.Ext(this.TempFilename))
+		this.TempPath = this.scratchPath("", this.TempFilename)
+	}
 	Log.Debug("Generated temporary path: %v", this.TempPath)
 	return nil
 }
@@ -178,6 +245,83 @@ func (this *TranscodeJob) randomString() string {
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
 
+// Build the ffmpeg command line for this job. Input options are kept
+// separate from output options so extra inputs can be added without
+// ffmpeg applying the output options to them.
+func (this *TranscodeJob) FFmpegArgs() ([]string, error) {
+	inputs := []string{"-i", this.Job.Path}
+	var opts []string
+	switch this.Type {
+	case MEDIA_AUDIO:
+		opts = strings.Split(this.Conf.TCSettings.Audio, " ")
+	case MEDIA_VIDEO:
+		opts = strings.Split(this.Conf.TCSettings.Video, " ")
+	default:
+		// Shouldn't get here as it should be dealt with further up.
+		return nil, fmt.Errorf("Unknown format, unable to handle.")
+	}
+
+	opts = this.threadArgs(opts)
+	opts = this.adaptiveArgs(opts)
+	opts = this.loudnessArgs(opts)
+	inputs, opts = this.subtitleArgs(inputs, opts)
+	inputs, opts = this.tagArgs(inputs, opts)
+	inputs, opts, err := this.commercialArgs(inputs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append(inputs, opts...)
+	args = append(args, "-y", this.TempPath)
+	args = append(args, this.renditionArgs()...)
+	return args, nil
+}
+
+// Value following flag in an argument list, or "" if it's not there.
+func optionValue(opts []string, flag string) string {
+	for i := 0; i < len(opts)-1; i++ {
+		if opts[i] == flag {
+			return opts[i+1]
+		}
+	}
+	return ""
+}
+
+// Copy of opts with flag set to value, replacing any existing value.
+func setOption(opts []string, flag, value string) []string {
+	out := append([]string{}, opts...)
+	for i := 0; i < len(out)-1; i++ {
+		if out[i] == flag {
+			out[i+1] = value
+			return out
+		}
+	}
+	return append(out, flag, value)
+}
+
+// Copy of opts without flag and its value.
+func removeOption(opts []string, flag string) []string {
+	out := make([]string, 0, len(opts))
+	for i := 0; i < len(opts); i++ {
+		if opts[i] == flag && i+1 < len(opts) {
+			i++
+			continue
+		}
+		out = append(out, opts[i])
+	}
+	return out
+}
+
+// Remove any temporary files made while building the ffmpeg command.
+func (this *TranscodeJob) removeScratchFiles() {
+	for _, f := range this.scratchFiles {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			Log.Warning("Unable to remove scratch file %v: %v", f, err)
+		}
+	}
+	this.scratchFiles = nil
+}
+
 // Do the actual transcoding! Should really be the only function you
 // need to call directly once the struct has been populated with data.
 func (this *TranscodeJob) Transcode() error {
@@ -195,44 +339,77 @@ func (this *TranscodeJob) Transcode() error {
 		this.Message = "File no longer exists? Nothing done."
 		Log.Warning("File '%v' no longer exists? Aborting transcode.", this.Job.Path)
 		this.SendNotifications()
-		return fmt.Errorf(this.Message)
+		return fmt.Errorf("%v", this.Message)
 	}
 	this.OldSize = oldstats.Size()
+	this.RecordedAt = oldstats.ModTime()
+
+	defer this.removeScratchFiles()
 
 	if err = this.GenerateTranscodeName(); err != nil {
 		this.Message = fmt.Sprintf("Error: %v", err.Error())
 		Log.Warning("Error: %v", err)
 		this.SendNotifications()
-		return fmt.Errorf(this.Message)
+		return fmt.Errorf("%v", this.Message)
+	}
+	if err = this.PrepareRenditions(); err != nil {
+		this.Message = fmt.Sprintf("Error: %v", err.Error())
+		Log.Warning(this.Message)
+		this.SendNotifications()
+		return err
+	}
+	if err = this.DB.SetTempPaths(this.Job.DBID, this.tempPaths()); err != nil {
+		Log.Warning(err.Error())
+	}
+	// Most of what follows wants the duration, as do the stats
+	if _, err = this.ProbeSource(); err != nil {
+		Log.Warning(err.Error())
 	}
 
-	tcsettings := make([]string, 2)
-	tcsettings[0] = "-i"
-	tcsettings[1] = this.Job.Path
-	switch this.Type {
-	case MEDIA_AUDIO:
-		tcsettings = append(tcsettings, strings.Split(this.Conf.TCSettings.Audio, " ")...)
-	case MEDIA_VIDEO:
-		tcsettings = append(tcsettings, strings.Split(this.Conf.TCSettings.Video, " ")...)
-	default:
-		// Shouldn't get here as it should be dealt with further up.
-		return fmt.Errorf("Unknown format, unable to handle.")
+	this.setStep("detecting commercials")
+	if err = this.DetectCommercials(); err != nil {
+		Log.Warning("Commercial detection failed, transcoding without: %v", err)
 	}
-	tcsettings = append(tcsettings, "-y")
-	tcsettings = append(tcsettings, this.TempPath)
 
-	Log.Debug("Executing command ffmpeg with arguments: %+v", tcsettings)
+	this.setStep("measuring loudness")
+	if err = this.MeasureLoudness(); err != nil {
+		Log.Warning("Loudness analysis failed, transcoding without normalisation: %v", err)
+	}
+	this.setStep("choosing encode settings")
+	if err = this.ChooseEncodeParams(); err != nil {
+		Log.Warning("Unable to choose adaptive encode parameters, using configured settings: %v", err)
+	}
 
-	cmd := exec.Command("ffmpeg", tcsettings...)
+	tcsettings, err := this.FFmpegArgs()
+	if err != nil {
+		this.Message = fmt.Sprintf("Error: %v", err.Error())
+		Log.Warning(this.Message)
+		this.SendNotifications()
+		return err
+	}
 
 	before := time.Now()
-	out, err := cmd.CombinedOutput()
+	this.setStep("first pass")
+	if err = this.RunFirstPass(tcsettings); err != nil {
+		this.ElapsedTime = time.Since(before)
+		this.Message = fmt.Sprintf("Error during transcode:\n\n%v", err)
+		Log.Warning(this.Message)
+		this.FailRenditions("Main encode failed")
+		this.SendNotifications()
+		return err
+	}
+
+	Log.Debug("Executing command ffmpeg with arguments: %+v", tcsettings)
+
+	this.setStep("transcoding")
+	out, err := this.RunFFmpeg(tcsettings)
 	this.ElapsedTime = time.Since(before)
 	if err != nil {
 		// TODO: Write this out to a temporary file instead, likely
 		// to be too big to send via pushover
 		this.Message = fmt.Sprintf("Error during transcode:\n\n%v", out)
 		Log.Warning(this.Message)
+		this.FailRenditions("Main encode failed")
 		this.SendNotifications()
 		return err
 	}
@@ -245,7 +422,18 @@ func (this *TranscodeJob) Transcode() error {
 		this.NewSize = newstats.Size()
 	}
 
-	path := this.Job.Path
+	if err = this.Verify(); err != nil {
+		this.Message = fmt.Sprintf("Output verification failed, original recording kept: %v", err)
+		Log.Warning(this.Message)
+		if rerr := os.Remove(this.TempPath); rerr != nil && !os.IsNotExist(rerr) {
+			Log.Warning("Unable to remove failed output '%v': %v", this.TempPath, rerr)
+		}
+		this.FailRenditions("Main output failed verification")
+		this.SendNotifications()
+		return err
+	}
+
+	path := this.OutputPath
 	Log.Debug("Path: %v", path)
 	path = strings.Replace(path, this.Conf.TrimPath, "", -1)
 	Log.Debug("Trim Path: %v", path)
@@ -257,16 +445,43 @@ func (this *TranscodeJob) Transcode() error {
 		humanize.IBytes(uint64(this.NewSize)),
 		path)
 
+	// Sequential renditions read from the original, so do them before it
+	// goes anywhere.
+	this.setStep("renditions")
+	this.RunRenditions()
+	this.FinishRenditions()
+	if len(this.Renditions) > 0 {
+		this.Message = fmt.Sprintf("%v\n\nRenditions:\n%v", this.Message, this.RenditionSummary())
+	}
+
+	// Has to happen while we've still got the original to read from
+	this.setStep("post-processing")
+	preErr := this.RunPreRenameSteps()
+	if preErr != nil {
+		Log.Warning(preErr.Error())
+	}
+	if err = this.DoRename(); err != nil {
+		this.Message = fmt.Sprintf("Error putting the transcoded file in place: %v", err)
+		Log.Warning(this.Message)
+		this.SkipPostProcessing("output not in place")
+		this.SendNotifications()
+		return err
+	}
 	Log.Info(this.Message)
 	this.Success = true
-	err = this.DoRename()
-	if err != nil {
-		Log.Warning("Error during rename: %v", err)
-	}
 	err = this.Cleanup()
 	if err != nil {
 		Log.Warning("Error during cleanup: %v", err)
 	}
+	err = this.RunPostProcessing()
+	if err != nil {
+		Log.Warning(err.Error())
+	}
+	for _, e := range []error{preErr, err} {
+		if e != nil {
+			this.Message = fmt.Sprintf("%v\n\n%v", this.Message, e)
+		}
+	}
 	this.SendNotifications()
 
 	return nil
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Used when the trash retention isn't set in the config.
+const defaultTrashRetention = 7 * 24 * time.Hour
+
+// How often the janitor looks for expired originals.
+const trashJanitorInterval = time.Hour
+
+const (
+	TRASH_TRASHED  = "trashed"
+	TRASH_RESTORED = "restored"
+	TRASH_PURGED   = "purged"
+)
+
+type TrashEntry struct {
+	ID           int64     `json:"id"`
+	JobID        int64     `json:"job_id"`
+	OriginalPath string    `json:"original_path"`
+	TrashPath    string    `json:"trash_path"`
+	OutputPath   string    `json:"output_path"`
+	Trashed      time.Time `json:"trashed"`
+	Expires      time.Time `json:"expires"`
+	State        string    `json:"state"`
+}
+
+var shutdownJanitor = make(chan bool)
+
+// Get rid of an original recording once it's been transcoded. If a trash
+// directory is configured the file is moved there to be purged later by
+// the janitor, otherwise it's deleted straight away.
+func (this *Database) TrashOriginal(conf *Config, jobID int64, original, output string) error {
+	if conf.Trash.Path == "" {
+		Log.Debug("Removing %v", original)
+		return os.Remove(original)
+	}
+
+	if err := os.MkdirAll(conf.Trash.Path, 0755); err != nil {
+		return fmt.Errorf("Unable to create trash directory: %v", err)
+	}
+
+	retention := conf.Trash.Retention
+	if retention <= 0 {
+		retention = defaultTrashRetention
+	}
+
+	entry := TrashEntry{
+		JobID:        jobID,
+		OriginalPath: original,
+		TrashPath:    filepath.Join(conf.Trash.Path, fmt.Sprintf("%d-%v", jobID, filepath.Base(original))),
+		OutputPath:   output,
+		Trashed:      time.Now(),
+		State:        TRASH_TRASHED,
+	}
+	entry.Expires = entry.Trashed.Add(retention)
+
+	Log.Debug("Moving %v to trash at %v", original, entry.TrashPath)
+	// The trash is usually on another filesystem, so this may be a copy
+	if err := moveFile(original, entry.TrashPath); err != nil {
+		return err
+	}
+
+	_, err := this.db.Exec(`INSERT INTO trash (jobid, originalpath, trashpath, outputpath, trashedtime, expires, state)
+							VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		entry.JobID, entry.OriginalPath, entry.TrashPath, entry.OutputPath, entry.Trashed, entry.Expires, entry.State)
+	if err != nil {
+		return fmt.Errorf("Original moved to '%v' but could not record it in the database: %v", entry.TrashPath, err)
+	}
+	return nil
+}
+
+func (this *Database) TrashedOriginals() ([]TrashEntry, error) {
+	rows, err := this.db.Query(`SELECT id, jobid, originalpath, trashpath, outputpath, trashedtime, expires, state
+								FROM trash WHERE state=? ORDER BY trashedtime DESC`, TRASH_TRASHED)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	entries := make([]TrashEntry, 0)
+	for rows.Next() {
+		e := TrashEntry{}
+		err := rows.Scan(&e.ID, &e.JobID, &e.OriginalPath, &e.TrashPath, &e.OutputPath, &e.Trashed, &e.Expires, &e.State)
+		if err != nil {
+			return nil, fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error retrieving trashed originals: %v", err)
+	}
+	return entries, nil
+}
+
+func (this *Database) TrashEntry(id int64) (*TrashEntry, error) {
+	e := &TrashEntry{}
+	err := this.db.QueryRow(`SELECT id, jobid, originalpath, trashpath, outputpath, trashedtime, expires, state
+							 FROM trash WHERE id=?`, id).
+		Scan(&e.ID, &e.JobID, &e.OriginalPath, &e.TrashPath, &e.OutputPath, &e.Trashed, &e.Expires, &e.State)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	return e, nil
+}
+
+func (this *Database) setTrashState(id int64, state string) error {
+	_, err := this.db.Exec("UPDATE trash SET state=? WHERE id=?", state, id)
+	return err
+}
+
+// Put a trashed original back where it came from, removing the transcoded
+// version that replaced it.
+func (this *Database) RestoreOriginal(id int64) (*TrashEntry, error) {
+	e, err := this.TrashEntry(id)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.State != TRASH_TRASHED {
+		return nil, fmt.Errorf("No trashed original with ID %d", id)
+	}
+
+	Log.Warning("Restoring original %v over transcoded output %v", e.OriginalPath, e.OutputPath)
+	// Original first, so a failed copy back doesn't leave us with neither
+	if err := moveFile(e.TrashPath, e.OriginalPath); err != nil {
+		return nil, fmt.Errorf("Unable to restore original: %v", err)
+	}
+	if e.OutputPath != "" && e.OutputPath != e.OriginalPath {
+		if err := os.Remove(e.OutputPath); err != nil && !os.IsNotExist(err) {
+			Log.Warning("Original restored but unable to remove transcoded output: %v", err)
+		}
+	}
+
+	if err := this.setTrashState(e.ID, TRASH_RESTORED); err != nil {
+		return nil, fmt.Errorf("Original restored but could not update database: %v", err)
+	}
+	e.State = TRASH_RESTORED
+	return e, nil
+}
+
+// Delete any trashed originals that have passed their retention period.
+func (this *Database) PurgeExpiredTrash() error {
+	rows, err := this.db.Query("SELECT id, trashpath FROM trash WHERE state=? AND expires <= ?", TRASH_TRASHED, time.Now())
+	if err != nil {
+		return fmt.Errorf("Error querying database: %v", err)
+	}
+	expired := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			rows.Close()
+			return fmt.Errorf("Error retrieving row from database: %v", err)
+		}
+		expired[id] = path
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error retrieving expired trash: %v", err)
+	}
+
+	for id, path := range expired {
+		Log.Info("Purging expired original %v", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			Log.Warning("Unable to purge %v: %v", path, err)
+			continue
+		}
+		if err := this.setTrashState(id, TRASH_PURGED); err != nil {
+			Log.Warning("Unable to mark trash entry %d as purged: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func StartTrashJanitor(db *Database) {
+	Log.Warning("Trash janitor starting up.")
+	go func() {
+		ticker := time.NewTicker(trashJanitorInterval)
+		defer ticker.Stop()
+		for {
+			if err := db.PurgeExpiredTrash(); err != nil {
+				Log.Error(err.Error())
+			}
+			select {
+			case <-ticker.C:
+			case <-shutdownJanitor:
+				Log.Warning("Trash janitor shutting down.")
+				return
+			}
+		}
+	}()
+}
+
+func StopTrashJanitor() {
+	go func() {
+		shutdownJanitor <- true
+	}()
+}
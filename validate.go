@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What TVHeadend passes as %e, from streaming_code2txt() and the DVR
+// status strings. Only "OK" gets transcoded, the rest just notify.
+var knownStatuses = []string{
+	"OK",
+	"Forced OK",
+	"Aborted by user",
+	"Not enough disk space",
+	"File missing",
+	"Time missed",
+	"Recording error",
+	"Invalid",
+	"Unknown reason",
+	"Source reconfigured",
+	"Source quality is bad",
+	"Source deleted",
+	"Subscription overridden",
+	"Invalid target",
+	"User access error",
+	"User limit reached",
+	"Weak stream",
+	"User request",
+	"Previously recorded",
+	"No free adapter",
+	"Mux not enabled",
+	"Adapter in use by another subscription",
+	"Tuning failed",
+	"No service enabled",
+	"Signal quality too poor",
+	"No source available",
+	"No service assigned to channel",
+	"No assigned adapters",
+	"Invalid service",
+	"Channel not enabled",
+	"No input detected",
+	"No descrambler",
+	"No access",
+}
+
+// Where recordings submitted to POST /job are allowed to live. Paths are
+// checked after following symlinks. Statuses adds to the ones TVHeadend
+// is known to send. Without any roots any existing file is accepted.
+type RecordingSettings struct {
+	Roots    []string `yaml:"roots"`
+	Statuses []string `yaml:"statuses"`
+	statuses map[string]bool
+}
+
+func (this *RecordingSettings) Prepare() error {
+	for i, root := range this.Roots {
+		if !filepath.IsAbs(root) {
+			return fmt.Errorf("Recording root '%v' must be an absolute path", root)
+		}
+		this.Roots[i] = filepath.Clean(root)
+	}
+	this.statuses = make(map[string]bool)
+	for _, s := range knownStatuses {
+		this.statuses[s] = true
+	}
+	for _, s := range this.Statuses {
+		this.statuses[s] = true
+	}
+	return nil
+}
+
+// A submitted job that can't be accepted, with the HTTP status to say so.
+type SubmitError struct {
+	Code    int
+	Message string
+}
+
+func (this *SubmitError) Error() string {
+	return this.Message
+}
+
+func submitError(code int, format string, args ...interface{}) *SubmitError {
+	return &SubmitError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Follow symlinks in as much of path as exists. A failed recording may not
+// have left a file behind, but where it would have been still matters.
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	dir, err := resolvePath(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Check a job posted to us and tidy it up: the path is resolved and the
+// filename taken from it rather than trusting what was sent. Whether the
+// file is there is left to CheckRecording.
+func (this *Config) ValidateJob(job *TVHJob) *SubmitError {
+	this.RLock()
+	defer this.RUnlock()
+	rec := &this.Recordings
+
+	job.Path = strings.TrimSpace(job.Path)
+	switch {
+	case job.Path == "":
+		return submitError(400, "Missing path")
+	case job.Channel == "":
+		return submitError(400, "Missing channel")
+	case job.Title == "":
+		return submitError(400, "Missing title")
+	case job.Status == "":
+		return submitError(400, "Missing status")
+	case !rec.statuses[job.Status]:
+		return submitError(400, "Unknown recording status '%v'", job.Status)
+	case !filepath.IsAbs(job.Path):
+		return submitError(400, "Path '%v' is not absolute", job.Path)
+	}
+
+	resolved, err := resolvePath(filepath.Clean(job.Path))
+	if err != nil {
+		return submitError(400, "Unable to resolve path '%v': %v", job.Path, err)
+	}
+	if len(rec.Roots) > 0 {
+		allowed := false
+		for _, root := range rec.Roots {
+			r, err := filepath.EvalSymlinks(root)
+			if err != nil {
+				r = root
+			}
+			if within(r, resolved) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return submitError(403, "Path '%v' is not under a recording root", job.Path)
+		}
+	}
+
+	if job.Filename != "" && job.Filename != filepath.Base(job.Path) {
+		Log.Debug("Ignoring submitted filename '%v' for '%v'", job.Filename, job.Path)
+	}
+	job.Path = resolved
+	job.Filename = filepath.Base(resolved)
+	return nil
+}
+
+// Only successful recordings get touched, so only they need to exist.
+func CheckRecording(job *TVHJob) *SubmitError {
+	if job.Status != "OK" {
+		return nil
+	}
+	st, err := os.Stat(job.Path)
+	switch {
+	case os.IsNotExist(err):
+		return submitError(404, "Recording '%v' does not exist", job.Path)
+	case err != nil:
+		return submitError(400, "Unable to stat '%v': %v", job.Path, err)
+	case !st.Mode().IsRegular():
+		return submitError(400, "Recording '%v' is not a regular file", job.Path)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		root, path string
+		want       bool
+	}{
+		{"/srv/rec", "/srv/rec/a.ts", true},
+		{"/srv/rec", "/srv/rec/show/a.ts", true},
+		{"/srv/rec", "/srv/rec", false},
+		{"/srv/rec", "/srv/recordings/a.ts", false},
+		{"/srv/rec", "/srv/a.ts", false},
+		{"/srv/rec", "/srv/rec/..a.ts", true},
+	}
+	for _, tt := range tests {
+		if got := within(tt.root, tt.path); got != tt.want {
+			t.Errorf("within(%q, %q) = %v, want %v", tt.root, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidateJob(t *testing.T) {
+	// Resolved up front, as the paths we get back will be
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "recordings")
+	outside := filepath.Join(base, "elsewhere")
+	for _, dir := range []string{root, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recording := filepath.Join(root, "news.ts")
+	secret := filepath.Join(outside, "secret.ts")
+	for _, f := range []string{recording, secret} {
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link inside the root pointing out of it, and one outside pointing in
+	if err := os.Symlink(secret, filepath.Join(root, "sneaky.ts")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := NewConfig()
+	conf.Recordings = RecordingSettings{Roots: []string{root}, Statuses: []string{"Something new"}}
+	if err := conf.Recordings.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	job := func(path, status string) *TVHJob {
+		return &TVHJob{Path: path, Filename: "whatever.ts", Channel: "BBC One", Title: "News", Status: status}
+	}
+	tests := []struct {
+		name     string
+		job      *TVHJob
+		code     int
+		wantPath string
+	}{
+		{"good", job(recording, "OK"), 0, recording},
+		{"padded path", job("  "+recording+" ", "OK"), 0, recording},
+		{"through a link to the root", job(filepath.Join(base, "link", "news.ts"), "OK"), 0, recording},
+		{"failed recording, no file", job(filepath.Join(root, "missing.ts"), "Time missed"), 0, filepath.Join(root, "missing.ts")},
+		{"configured status", job(recording, "Something new"), 0, recording},
+		{"unknown status", job(recording, "Bad vibes"), 400, ""},
+		{"missing channel", &TVHJob{Path: recording, Title: "News", Status: "OK"}, 400, ""},
+		{"missing path", job("", "OK"), 400, ""},
+		{"relative", job("recordings/news.ts", "OK"), 400, ""},
+		{"outside roots", job(secret, "OK"), 403, ""},
+		{"dot dot escape", job(filepath.Join(root, "..", "elsewhere", "secret.ts"), "OK"), 403, ""},
+		{"symlink out of the root", job(filepath.Join(root, "sneaky.ts"), "OK"), 403, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := conf.ValidateJob(tt.job)
+			switch {
+			case tt.code == 0 && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.code != 0 && err == nil:
+				t.Fatalf("accepted, want HTTP %v", tt.code)
+			case err != nil && err.Code != tt.code:
+				t.Fatalf("got HTTP %v (%v), want %v", err.Code, err, tt.code)
+			}
+			if err == nil {
+				if tt.job.Path != tt.wantPath || tt.job.Filename != filepath.Base(tt.wantPath) {
+					t.Errorf("path %q, filename %q, want %q", tt.job.Path, tt.job.Filename, tt.wantPath)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckRecording(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.ts")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		status string
+		code   int
+	}{
+		{"exists", file, "OK", 0},
+		{"missing", filepath.Join(dir, "b.ts"), "OK", 404},
+		{"directory", dir, "OK", 400},
+		{"missing but failed anyway", filepath.Join(dir, "b.ts"), "Time missed", 0},
+	}
+	for _, tt := range tests {
+		err := CheckRecording(&TVHJob{Path: tt.path, Status: tt.status})
+		code := 0
+		if err != nil {
+			code = err.Code
+		}
+		if code != tt.code {
+			t.Errorf("%v: got %v (%v), want %v", tt.name, code, err, tt.code)
+		}
+	}
+}
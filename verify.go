@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Used when duration_tolerance isn't set in the config.
+const defaultDurationTolerance float64 = 5
+
+// Probe the source recording, caching the result on the job so we only
+// have to do it once.
+func (this *TranscodeJob) ProbeSource() (*ProbeResult, error) {
+	if this.SourceProbe != nil {
+		return this.SourceProbe, nil
+	}
+	pr, err := Probe(this.Job.Path)
+	if err != nil {
+		return nil, err
+	}
+	this.SourceProbe = pr
+	return pr, nil
+}
+
+// How long the output should be, in seconds. That's the length of the
+// source, less any adverts we're cutting out. Returns 0 if the source
+// couldn't be probed.
+func (this *TranscodeJob) ExpectedDuration() float64 {
+	src, err := this.ProbeSource()
+	if err != nil {
+		return 0
+	}
+	d := src.Duration()
+	if d > 0 && this.CommercialAction == COMMERCIAL_CUT {
+		d -= this.CommercialDuration()
+	}
+	return d
+}
+
+// Make sure the transcoded output actually looks like the source before
+// we let anything delete the original. ffmpeg exiting 0 isn't enough, it
+// will quite happily write a truncated file if the input is damaged.
+func (this *TranscodeJob) Verify() error {
+	vs := this.Conf.Verify
+	if !vs.Enabled {
+		return nil
+	}
+
+	if err := this.VerifyMedia(this.TempPath); err != nil {
+		return err
+	}
+
+	if this.OldSize > 0 {
+		ratio := float64(this.NewSize) / float64(this.OldSize)
+		Log.Debug("Verifying size ratio: %.3f", ratio)
+		if vs.MinSizeRatio > 0 && ratio < vs.MinSizeRatio {
+			return fmt.Errorf("Output is %.3f the size of the source, below the minimum of %.3f", ratio, vs.MinSizeRatio)
+		}
+		if vs.MaxSizeRatio > 0 && ratio > vs.MaxSizeRatio {
+			return fmt.Errorf("Output is %.3f the size of the source, above the maximum of %.3f", ratio, vs.MaxSizeRatio)
+		}
+	}
+
+	return nil
+}
+
+// Check the duration and streams of a transcoded file against the source.
+// Used for every output, the size checks in Verify only make sense for
+// the main one.
+func (this *TranscodeJob) VerifyMedia(path string) error {
+	src, err := this.ProbeSource()
+	if err != nil {
+		return fmt.Errorf("Unable to probe source: %v", err)
+	}
+	out, err := Probe(path)
+	if err != nil {
+		return fmt.Errorf("Unable to probe output: %v", err)
+	}
+
+	tolerance := this.Conf.Verify.DurationTolerance
+	if tolerance <= 0 {
+		tolerance = defaultDurationTolerance
+	}
+	srcDuration, outDuration := this.ExpectedDuration(), out.Duration()
+	Log.Debug("Verifying durations: source %.2fs, output %.2fs (tolerance %.2fs)", srcDuration, outDuration, tolerance)
+	if outDuration == 0 {
+		return fmt.Errorf("Output has no duration")
+	}
+	if srcDuration > 0 && math.Abs(srcDuration-outDuration) > tolerance {
+		return fmt.Errorf("Output duration %.2fs differs from source duration %.2fs by more than %.2fs",
+			outDuration, srcDuration, tolerance)
+	}
+
+	for _, st := range []string{"video", "audio"} {
+		if src.StreamCount(st) > 0 && out.StreamCount(st) == 0 {
+			return fmt.Errorf("Source has %v stream(s) but output has none", st)
+		}
+	}
+	return nil
+}